@@ -0,0 +1,77 @@
+package hobo
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// A cached boxcar is either a downloaded archive or an unpacked vmwarevm
+// directory that clones are made from.
+type CachedBoxcar struct {
+	Name string
+	Path string
+	// Kind is archive or unpacked.
+	Kind  string
+	Bytes int64
+}
+
+const (
+	cacheKindArchive  = "archive"
+	cacheKindUnpacked = "unpacked"
+)
+
+// Return the allocated size of everything under root.
+func diskUsageTree(root string) (int64, error) {
+	total := int64(0)
+	err := filepath.Walk(root, func(fname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			total += st.Blocks * 512
+		} else {
+			total += fi.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// Return every cached boxcar, archives and unpacked directories alike.
+func (ac *AppConfig) CachedBoxcars() ([]CachedBoxcar, error) {
+	fis, err := ioutil.ReadDir(ac.boxcarsDir())
+	if os.IsNotExist(err) {
+		return []CachedBoxcar{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	boxcars := make([]CachedBoxcar, 0, len(fis))
+	for _, fi := range fis {
+		// Dot files are partial downloads.
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		bxc := CachedBoxcar{
+			Name:  fi.Name(),
+			Path:  path.Join(ac.boxcarsDir(), fi.Name()),
+			Kind:  cacheKindArchive,
+			Bytes: fi.Size(),
+		}
+		if fi.IsDir() {
+			if path.Ext(fi.Name()) != ".vmwarevm" {
+				continue
+			}
+			bxc.Name = strings.TrimSuffix(fi.Name(), ".vmwarevm")
+			bxc.Kind = cacheKindUnpacked
+			if bxc.Bytes, err = diskUsageTree(bxc.Path); err != nil {
+				return nil, err
+			}
+		}
+		boxcars = append(boxcars, bxc)
+	}
+	return boxcars, nil
+}
@@ -0,0 +1,62 @@
+package hobo
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Cleanups undo partial work, like temp files and half finished clones.
+// Deferred calls already do this when an operation fails, but a program
+// that exits without unwinding, say on a signal or through os.Exit, should
+// call RunCleanups first.
+var (
+	cleanupMu     sync.Mutex
+	cleanupNextId int
+	cleanups      = make(map[int]func())
+)
+
+// Register fn to run if hobo exits early. The returned func unregisters it
+// once the work it protects is complete.
+func addCleanup(fn func()) (remove func()) {
+	cleanupMu.Lock()
+	defer cleanupMu.Unlock()
+	id := cleanupNextId
+	cleanupNextId++
+	cleanups[id] = fn
+	return func() {
+		cleanupMu.Lock()
+		defer cleanupMu.Unlock()
+		delete(cleanups, id)
+	}
+}
+
+// Run registered cleanups in reverse order of registration. Each one only
+// ever runs once.
+func RunCleanups() {
+	cleanupMu.Lock()
+	fns := make([]func(), 0, len(cleanups))
+	for id := cleanupNextId - 1; id >= 0; id-- {
+		if fn, ok := cleanups[id]; ok {
+			fns = append(fns, fn)
+			delete(cleanups, id)
+		}
+	}
+	cleanupMu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// Return true if ctx was cancelled by an interrupt rather than a timeout.
+func interrupted(ctx context.Context) bool {
+	return ctx.Err() == context.Canceled
+}
+
+// Bound ctx by d, or leave it alone if d is zero.
+func withTimeout(ctx context.Context, d Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(d))
+}
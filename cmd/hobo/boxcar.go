@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+
+	"github.com/msolo/cmdflag"
+)
+
+func runMakeBoxcar(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+
+	if len(args) != 1 {
+		fatalf("failed: make-boxcar requires a path to a vmwarevm directory")
+	}
+	if _, err := cfg.AppConfig.MakeBoxcar(ctx, args[0]); err != nil {
+		fatalf("failed: %v", err)
+	}
+}
+
+var cmdMakeBoxcar = &cmdflag.Command{
+	Name:      "make-boxcar",
+	Run:       runMakeBoxcar,
+	UsageLine: "hobo make-boxcar <boxcar name>.vmwarevm",
+	UsageLong: `Create a new boxcar archive.`,
+	Args:      cmdflag.PredictDirs("*.vmwarevm"),
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/msolo/cmdflag"
+	"github.com/msolo/hobo"
+)
+
+type cacheOutput struct {
+	Boxcars []hobo.CachedBoxcar
+}
+
+func runCache(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	if len(args) != 1 || args[0] != "ls" {
+		fatalf("failed: cache requires ls")
+	}
+	boxcars, err := cfg.AppConfig.CachedBoxcars()
+	if err != nil {
+		fatalf("failed reading cache: %v", err)
+	}
+	if jsonOutput() {
+		writeJson(cacheOutput{Boxcars: boxcars})
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, bxc := range boxcars {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", bxc.Name, bxc.Kind, formatBytes(bxc.Bytes), bxc.Path)
+	}
+	tw.Flush()
+}
+
+var cmdCache = &cmdflag.Command{
+	Name:      "cache",
+	Run:       runCache,
+	UsageLine: "hobo cache ls",
+	UsageLong: `Show cached boxcar archives and unpacked boxcars.`,
+	Args:      cmdflag.PredictSet("ls"),
+}
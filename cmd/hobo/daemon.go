@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+
+	"github.com/msolo/cmdflag"
+	"github.com/msolo/hobo"
+)
+
+// noDaemon is set by the global -no-daemon flag.
+var noDaemon bool
+
+// Return a client for the daemon if it is running and -no-daemon wasn't
+// given, or nil to run commands locally.
+func daemonClient(cfg *hobo.Config) *hobo.DaemonClient {
+	if noDaemon {
+		return nil
+	}
+	return cfg.AppConfig.DaemonClient()
+}
+
+func runDaemon(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	if len(args) != 0 {
+		fatalf("failed: daemon takes no arguments")
+	}
+	if err := cfg.AppConfig.ServeDaemon(ctx); err != nil {
+		fatalf("failed: %v", err)
+	}
+}
+
+var cmdDaemon = &cmdflag.Command{
+	Name:      "daemon",
+	Run:       runDaemon,
+	UsageLine: "hobo daemon",
+	UsageLong: `Serve a json api for all VMs on a unix socket in the hobo data dir.
+
+While the daemon is running, start, stop, suspend and status are sent to it
+unless -no-daemon is given.`,
+}
+
+func runWatch(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	if len(args) != 0 {
+		fatalf("failed: watch takes no arguments")
+	}
+	if err := cfg.AppConfig.WatchIdle(ctx); err != nil {
+		fatalf("failed: %v", err)
+	}
+}
+
+var cmdWatch = &cmdflag.Command{
+	Name:      "watch",
+	Run:       runWatch,
+	UsageLine: "hobo watch",
+	UsageLong: `Suspend VMs that have been idle for longer than their IdleSuspendAfter.
+
+A VM is idle when nobody is logged in, nothing is connected to its forwarded
+ports and its load average is low. hobo daemon does the same thing, so this
+is only needed when the daemon isn't running.`,
+}
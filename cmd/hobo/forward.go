@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/msolo/cmdflag"
+)
+
+func runForward(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	if len(args) == 0 {
+		fatalf("failed: forward requires one of ls, add, rm")
+	}
+	// The machine name, if any, follows the subcommand and its spec.
+	nargs := 1
+	switch args[0] {
+	case "add", "rm":
+		nargs = 2
+	}
+	if len(args) < nargs {
+		fatalf("failed: forward %s requires a port spec", args[0])
+	}
+	m, err := machineForArgs(cfg, args[nargs:])
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+
+	switch args[0] {
+	case "ls":
+		current, active, err := cfg.InstanceForwards(m.Key)
+		if err != nil {
+			fatalf("failed: %v", err)
+		}
+		state := "stopped"
+		if active {
+			state = "active"
+		}
+		for _, fw := range current {
+			kind := "declared"
+			if fw.Adhoc {
+				kind = "adhoc"
+			}
+			fmt.Printf("%s\t%s\t%s\n", fw, kind, state)
+		}
+	case "add":
+		if err := cfg.AddForward(ctx, m.Key, args[1]); err != nil {
+			fatalf("failed adding forward: %v", err)
+		}
+	case "rm":
+		if err := cfg.RemoveForward(ctx, m.Key, args[1]); err != nil {
+			fatalf("failed removing forward: %v", err)
+		}
+	case "supervise":
+		if err := cfg.SuperviseForwards(ctx, m.Key); err != nil {
+			fatalf("failed forwarding: %v", err)
+		}
+	default:
+		fatalf("failed: unknown forward command %q", args[0])
+	}
+}
+
+var cmdForward = &cmdflag.Command{
+	Name:      "forward",
+	Run:       runForward,
+	UsageLine: "hobo forward ls | add [bind_addr:]host_port:guest_port | rm [bind_addr:]host_port [machine]",
+	UsageLong: `Manage TCP port forwards from the host into a VM.
+
+Forwards declared in .hobo are established by start and torn down by stop,
+suspend and rm. Adhoc forwards last until they are removed or the VM is stopped.`,
+	Args: cmdflag.PredictSet("ls", "add", "rm"),
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/msolo/cmdflag"
+	"github.com/msolo/hobo"
+)
+
+func runStart(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	machines, err := cfg.MachinesFor(args)
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	dc := daemonClient(cfg)
+	for _, m := range machines {
+		if dc != nil {
+			if err := dc.Start(ctx, cfg, m.Key); err != nil {
+				fatalf("failed: %v", err)
+			}
+			continue
+		}
+		if _, err := cfg.Start(ctx, m.Key); err != nil {
+			fatalf("failed: %v", err)
+		}
+	}
+}
+
+func runStop(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	var hard bool
+	flags := cmd.BindFlagSet(map[string]interface{}{"force": &hard})
+	err := flags.Parse(args)
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	machines, err := cfg.MachinesFor(flags.Args())
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+
+	dc := daemonClient(cfg)
+	for _, m := range machines {
+		if dc != nil {
+			err = dc.Stop(ctx, m.Name, hard)
+		} else {
+			err = cfg.Stop(ctx, m.Key, hard)
+		}
+		// A machine that was never created is as stopped as it gets.
+		if errors.Is(err, hobo.ErrNotFound) {
+			hobo.StdLogger.Infof("%s was never created", m.Name)
+		} else if err != nil {
+			fatalf("failed: %v", err)
+		}
+	}
+}
+
+func runSuspend(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	machines, err := cfg.MachinesFor(args)
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	dc := daemonClient(cfg)
+	for _, m := range machines {
+		if dc != nil {
+			err = dc.Suspend(ctx, m.Name)
+		} else {
+			err = cfg.Suspend(ctx, m.Key)
+		}
+		if errors.Is(err, hobo.ErrNotFound) {
+			hobo.StdLogger.Infof("%s was never created", m.Name)
+		} else if err != nil {
+			fatalf("failed: %v", err)
+		}
+	}
+}
+
+var errDeclined = errors.New("prompt declined")
+
+func prompt(msg, affirmative string) error {
+	fmt.Print(msg)
+	reply := ""
+	_, err := fmt.Scanf("%s\n", &reply)
+	if err != nil {
+		return err
+	}
+	if reply != affirmative {
+		return errDeclined
+	}
+	return nil
+}
+
+func runRm(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	machines, err := cfg.MachinesFor(args)
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	keys := make([]string, 0, len(machines))
+	names := make([]string, 0, len(machines))
+	for _, m := range machines {
+		st, err := cfg.Status(ctx, m.Key)
+		if err != nil {
+			fatalf("failed: %v", err)
+		}
+		if st.State == hobo.StateNotCreated {
+			hobo.StdLogger.Infof("%s was never created", m.Name)
+			continue
+		}
+		keys = append(keys, m.Key)
+		names = append(names, m.Name)
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	msg := fmt.Sprintf("Permanently remove %s and all data? [yes/NO] ", strings.Join(names, ", "))
+	if err := prompt(msg, "yes"); err != nil {
+		fatalf("aborted: %v", err)
+	}
+	for _, key := range keys {
+		if err := cfg.Remove(ctx, key); err != nil {
+			fatalf("failed: %v", err)
+		}
+	}
+}
+
+func runFetch(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	machines, err := cfg.MachinesFor(args)
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	out := fetchOutput{Boxcars: make([]fetchedBoxcar, 0, len(machines))}
+	for _, m := range machines {
+		fetched, err := cfg.Fetch(ctx, m.Key)
+		if err != nil {
+			fatalf("failed: %v", err)
+		}
+		out.Boxcars = append(out.Boxcars, fetchedBoxcar{
+			Name:    m.Boxcar.Name,
+			Version: m.Boxcar.Version,
+			Url:     m.Boxcar.Url,
+			Sha256:  m.Boxcar.Sha256,
+			Archive: cfg.AppConfig.ArchivePath(m.Boxcar),
+			Fetched: fetched,
+		})
+	}
+	if jsonOutput() {
+		writeJson(out)
+	}
+}
+
+type fetchedBoxcar struct {
+	Name    string
+	Version string
+	Url     string
+	Sha256  string
+	Archive string
+	// Fetched is false if a verified archive was already cached.
+	Fetched bool
+}
+
+type fetchOutput struct {
+	Boxcars []fetchedBoxcar
+}
+
+var cmdStart = &cmdflag.Command{
+	Name:      "start",
+	Run:       runStart,
+	UsageLine: "hobo start [machine ...]",
+	UsageLong: `Start a VM.`,
+}
+
+var cmdStop = &cmdflag.Command{
+	Name:      "stop",
+	Run:       runStop,
+	UsageLine: "hobo stop [-force] [machine ...]",
+	UsageLong: `Stop a VM.
+
+The guest is shut down through VMware Tools, or with sudo poweroff over ssh
+if Tools don't respond. If it is still running after the Shutdown timeout,
+it is powered off hard.`,
+	Flags: []cmdflag.Flag{
+		{"force", cmdflag.FlagTypeBool, false, "Power off the VM immediately.", nil},
+	},
+}
+
+var cmdSuspend = &cmdflag.Command{
+	Name:      "suspend",
+	Run:       runSuspend,
+	UsageLine: "hobo suspend [machine ...]",
+	UsageLong: `Suspend a VM.`,
+}
+
+var cmdRm = &cmdflag.Command{
+	Name:      "rm",
+	Run:       runRm,
+	UsageLine: "hobo rm [machine ...]",
+	UsageLong: `Destroy a VM and permanently remove all data files.`,
+}
+
+var cmdFetch = &cmdflag.Command{
+	Name:      "fetch",
+	Run:       runFetch,
+	UsageLine: "hobo fetch [machine ...]",
+	UsageLong: `Pull down a boxcar archive.`,
+}
+
+func runRestart(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	m, err := machineForArgs(cfg, args)
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	if dc := daemonClient(cfg); dc != nil {
+		err = dc.Restart(ctx, m.Name)
+	} else {
+		err = cfg.Restart(ctx, m.Key)
+	}
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+}
+
+var cmdRestart = &cmdflag.Command{
+	Name:      "restart",
+	Run:       runRestart,
+	UsageLine: "hobo restart [machine]",
+	UsageLong: `Reboot a running VM and wait for ssh.`,
+}
+
+func runResume(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	m, err := machineForArgs(cfg, args)
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	if dc := daemonClient(cfg); dc != nil {
+		err = dc.Resume(ctx, cfg, m.Key)
+	} else {
+		_, err = cfg.Resume(ctx, m.Key)
+	}
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+}
+
+var cmdResume = &cmdflag.Command{
+	Name:      "resume",
+	Run:       runResume,
+	UsageLine: "hobo resume [machine]",
+	UsageLong: `Resume a suspended VM, wait for ssh and sync the guest clock.`,
+}
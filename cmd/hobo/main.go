@@ -0,0 +1,261 @@
+// Command hobo manages local VMware virtual machines built from boxcars.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/msolo/cmdflag"
+	"github.com/msolo/hobo"
+)
+
+const (
+	doc = `hobo - manage local virtual machines
+
+Configuration is read from -config-file, ./.hobo, or ~/.hobo - whichever occurs first.
+
+When the configuration defines several machines, commands take machine names.
+start, stop, suspend, rm, fetch and status act on all machines by default, the
+others act on the default machine.
+
+start - start a vm
+stop - stop a vm
+suspend - suspend a vm
+resume - resume a suspended vm
+restart - reboot a vm
+
+status - show the state of a vm
+ip-addr - return the current ip address for a vm
+ssh - ssh into a vm
+exec - run a command in a vm
+ssh-config - generate an ssh config clause for a vm
+
+ls - show running vms, or all vms with -a
+rm - destroy a vm and permanently remove all data files
+rekey - rotate the ssh client key for a vm
+provision - run the provisioners for a vm again
+
+forward - manage port forwards from the host into a vm
+
+daemon - serve a json api for all vms on a unix socket
+watch - suspend idle vms
+
+fetch - pull down a boxcar archive
+cache ls - show cached boxcar archives
+
+make-boxcar <boxcar name>.vmwarevw - create a new boxcar archive
+`
+)
+
+var cmdHobo = &cmdflag.Command{
+	Name:      "hobo",
+	UsageLong: doc,
+	Flags: []cmdflag.Flag{
+		{"timeout", cmdflag.FlagTypeDuration, 0 * time.Millisecond, "timeout for command execution", nil},
+		{"data-dir", cmdflag.FlagTypeString, "$HOME/.hobo.d", "directory for all hobo vm data", cmdflag.PredictDirs("*")},
+		{"config-file", cmdflag.FlagTypeString, "", "local config file", cmdflag.PredictFiles("*")},
+		{"format", cmdflag.FlagTypeString, formatText, "output format, text or json", cmdflag.PredictSet(formatText, formatJson)},
+		{"v", cmdflag.FlagTypeBool, false, "log debug messages, including commands run", nil},
+		{"q", cmdflag.FlagTypeBool, false, "only log warnings and errors", nil},
+		{"log-format", cmdflag.FlagTypeString, hobo.LogFormatText, "log format on stderr, text or json", cmdflag.PredictSet(hobo.LogFormatText, hobo.LogFormatJson)},
+		{"no-daemon", cmdflag.FlagTypeBool, false, "run commands locally even if hobo daemon is running", nil},
+	},
+}
+
+var commands = []*cmdflag.Command{
+	cmdStart,
+	cmdStop,
+	cmdSuspend,
+	cmdResume,
+	cmdRestart,
+	cmdIpAddr,
+	cmdSsh,
+	cmdExec,
+	cmdSshConfig,
+	cmdLs,
+	cmdRm,
+	cmdRekey,
+	cmdProvision,
+	cmdStatus,
+	cmdForward,
+	cmdFetch,
+	cmdCache,
+	cmdDaemon,
+	cmdWatch,
+	cmdMakeBoxcar,
+}
+
+func findConfigFile(fname string) string {
+	searchPaths := []string{".hobo", "$HOME/.hobo"}
+	if fname != "" {
+		return fname
+	}
+	for _, name := range searchPaths {
+		name = os.ExpandEnv(name)
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+type contextKey string
+
+const localConfigKey = contextKey("Config")
+
+func ctxCfg(ctx context.Context) *hobo.Config {
+	return ctx.Value(localConfigKey).(*hobo.Config)
+}
+
+func main() {
+	var timeout time.Duration
+	var hoboDir string
+	var configFile string
+	var verbose, quiet bool
+	var logFormat string
+
+	cmdHobo.BindFlagSet(map[string]interface{}{"timeout": &timeout,
+		"data-dir":    &hoboDir,
+		"config-file": &configFile,
+		"format":      &outputFormat,
+		"v":           &verbose,
+		"q":           &quiet,
+		"log-format":  &logFormat,
+		"no-daemon":   &noDaemon})
+
+	cmd, args := cmdflag.Parse(cmdHobo, commands)
+	if format := outputFormat; format != formatText && format != formatJson {
+		outputFormat = formatText
+		fatalf("invalid -format %q, expected text or json", format)
+	}
+	if err := hobo.SetLogFormat(logFormat); err != nil {
+		fatalf("%v", err)
+	}
+	if verbose {
+		hobo.SetLogLevel(hobo.LevelDebug)
+	} else if quiet {
+		hobo.SetLogLevel(hobo.LevelWarn)
+	}
+
+	cfgFname := ""
+	switch cmd.Name {
+	case "make-boxcar", "ls", "cache", "daemon", "watch":
+	default:
+		cfgFname = findConfigFile(configFile)
+		if cfgFname == "" {
+			fatalf("unable to find a .hobo file in the search path")
+		}
+	}
+
+	cfg, err := hobo.LoadConfig(cfgFname)
+	if err != nil {
+		fatalf("failed reading config: %s", err)
+	}
+
+	if cfg.AppConfig.HoboDir == "" {
+		cfg.AppConfig.HoboDir = hoboDir
+	}
+
+	ctx := context.WithValue(context.Background(), localConfigKey, cfg)
+	ctx, cancel := withInterrupt(ctx)
+	defer cancel()
+	if timeout > 0 {
+		nctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		ctx = nctx
+	}
+
+	cmd.Run(ctx, cmd, args)
+}
+
+// Return the machine named in args, or the default machine if there are
+// none.
+func machineForArgs(cfg *hobo.Config, args []string) (*hobo.Machine, error) {
+	if len(args) > 1 {
+		return nil, fmt.Errorf("too many arguments: %v", args)
+	}
+	key := ""
+	if len(args) == 1 {
+		key = args[0]
+	}
+	return cfg.Machine(key)
+}
+
+// Return the running instance for a machine. A suspended vm is always
+// resumed, since it may only have been suspended for being idle. A stopped
+// vm is started, and a missing one created, only with autostart.
+func runningInstance(ctx context.Context, cfg *hobo.Config, m *hobo.Machine, autostart bool) (*hobo.Instance, error) {
+	vm, err := cfg.Instance(m.Key)
+	if errors.Is(err, hobo.ErrNotFound) {
+		if !autostart {
+			return nil, fmt.Errorf("%w: run hobo start or use -autostart", err)
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		state, err := vm.State(ctx)
+		if err != nil {
+			return nil, err
+		}
+		switch state {
+		case hobo.StateRunning:
+			return vm, nil
+		case hobo.StateSuspended:
+			vm.Logger().Infof("Resuming suspended vm")
+		default:
+			if !autostart {
+				return nil, fmt.Errorf("%s: %w: run hobo start or use -autostart", m.Name, hobo.ErrNotRunning)
+			}
+		}
+	}
+
+	if dc := daemonClient(cfg); dc != nil {
+		if err := dc.Start(ctx, cfg, m.Key); err != nil {
+			return nil, err
+		}
+		return cfg.Instance(m.Key)
+	}
+	return cfg.Start(ctx, m.Key)
+}
+
+// Bind -autostart with its default from the config.
+func bindAutostartFlag(cmd *cmdflag.Command, cfg *hobo.Config, autostart *bool) *flag.FlagSet {
+	flags := cmd.BindFlagSet(map[string]interface{}{"autostart": autostart})
+	*autostart = cfg.Autostart
+	return flags
+}
+
+// Cancel the returned context on SIGINT or SIGTERM. Everything downstream
+// sees the cancellation and fails, running cleanups on the way out. A
+// second signal or a stuck command cleans up and exits immediately.
+func withInterrupt(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	sigC := make(chan os.Signal, 2)
+	signal.Notify(sigC, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigC:
+			hobo.StdLogger.Warnf("Caught %v, cleaning up", sig)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-sigC:
+		case <-time.After(interruptGracePeriod):
+		}
+		hobo.RunCleanups()
+		os.Exit(130)
+	}()
+	return ctx, cancel
+}
+
+// How long an interrupted command has to notice its context is cancelled
+// and fail on its own before we clean up and exit anyway.
+const interruptGracePeriod = 10 * time.Second
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/msolo/hobo"
+)
+
+func TestMachineForArgs(t *testing.T) {
+	single := &hobo.Config{Name: "dev"}
+	multi := &hobo.Config{
+		Name:           "integ",
+		DefaultMachine: "app",
+		Machines:       map[string]hobo.MachineConfig{"app": {}, "db": {}},
+	}
+	noDefault := &hobo.Config{
+		Name:     "integ",
+		Machines: map[string]hobo.MachineConfig{"app": {}, "db": {}},
+	}
+	tests := []struct {
+		name    string
+		cfg     *hobo.Config
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{"single", single, nil, "dev", false},
+		{"single named", single, []string{"db"}, "", true},
+		// With no args, restart and resume act on the default machine
+		// rather than every machine.
+		{"no args", multi, nil, "integ-app", false},
+		{"named", multi, []string{"db"}, "integ-db", false},
+		{"unknown", multi, []string{"web"}, "", true},
+		{"too many", multi, []string{"app", "db"}, "", true},
+		{"no default", noDefault, nil, "", true},
+	}
+	for _, tt := range tests {
+		m, err := machineForArgs(tt.cfg, tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: machineForArgs(%q) error = %v, wantErr %v", tt.name, tt.args, err, tt.wantErr)
+			continue
+		}
+		if err == nil && m.Name != tt.want {
+			t.Errorf("%s: machineForArgs(%q) = %s, want %s", tt.name, tt.args, m.Name, tt.want)
+		}
+	}
+}
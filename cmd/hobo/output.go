@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/msolo/hobo"
+)
+
+const (
+	formatText = "text"
+	formatJson = "json"
+)
+
+// outputFormat is set by the global -format flag. In json mode, commands
+// write a single json object to stdout and errors are reported as
+// {"Error": "..."}. Progress logging always goes to stderr.
+var outputFormat = formatText
+
+func jsonOutput() bool {
+	return outputFormat == formatJson
+}
+
+// Write v to stdout as indented json.
+func writeJson(v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		hobo.StdLogger.Errorf("failed encoding output: %v", err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(append(data, '\n'))
+}
+
+type errorOutput struct {
+	Error string
+}
+
+// Log a fatal error, run cleanups and exit. This stands in for log.Fatalf so
+// errors are machine readable in json mode.
+func fatalf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if jsonOutput() {
+		writeJson(errorOutput{Error: hobo.Redact(msg)})
+	}
+	hobo.StdLogger.Output(2, hobo.LevelError, msg)
+	hobo.RunCleanups()
+	os.Exit(1)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+
+	"github.com/msolo/cmdflag"
+	"github.com/msolo/hobo"
+)
+
+func runProvision(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	var resume, changed bool
+	flags := cmd.BindFlagSet(map[string]interface{}{"resume": &resume, "changed": &changed})
+	if err := flags.Parse(args); err != nil {
+		fatalf("failed: %v", err)
+	}
+	if resume && changed {
+		fatalf("failed: -resume and -changed are exclusive")
+	}
+	m, err := machineForArgs(cfg, flags.Args())
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	mode := hobo.ProvisionAll
+	if resume {
+		mode = hobo.ProvisionResume
+	} else if changed {
+		mode = hobo.ProvisionChanged
+	}
+
+	if _, err := runningInstance(ctx, cfg, m, false); err != nil {
+		fatalf("failed: %v", err)
+	}
+	if err := cfg.Provision(ctx, m.Key, mode); err != nil {
+		fatalf("failed provisioning: %v", err)
+	}
+}
+
+var cmdProvision = &cmdflag.Command{
+	Name:      "provision",
+	Run:       runProvision,
+	UsageLine: "hobo provision [-resume | -changed] [machine]",
+	UsageLong: `Run the Provisioners for a VM again.
+
+Provisioners run once after bootstrap, and each step is recorded as it
+completes. With -resume, a failed bootstrap continues from the step that
+failed. With -changed, only the bootstrap steps that changed since they last
+completed are run, including BootstrapCmdLines.`,
+	Flags: []cmdflag.Flag{
+		{"resume", cmdflag.FlagTypeBool, false, "Skip the steps that completed before the first that did not.", nil},
+		{"changed", cmdflag.FlagTypeBool, false, "Only run steps that changed.", nil},
+	},
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/msolo/cmdflag"
+	"github.com/msolo/hobo"
+)
+
+func runIpAddr(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	var autostart bool
+	flags := bindAutostartFlag(cmd, cfg, &autostart)
+	if err := flags.Parse(args); err != nil {
+		fatalf("failed: %v", err)
+	}
+	m, err := machineForArgs(cfg, flags.Args())
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+
+	vm, err := runningInstance(ctx, cfg, m, autostart)
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	res, err := vm.RefreshIpAddr(ctx)
+	if err != nil {
+		fatalf("failed finding ip addr: %v", err)
+	}
+	if jsonOutput() {
+		writeJson(ipAddrOutput{Name: vm.Name(), IpAddr: res.IpAddr, Source: res.Source})
+		return
+	}
+	println(res.IpAddr)
+}
+
+type ipAddrOutput struct {
+	Name   string
+	IpAddr string
+	// Source is the resolver that found the address, one of cache,
+	// dhcp-lease, arp or vmtools.
+	Source string
+}
+
+func runSsh(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	var autostart bool
+	flags := bindAutostartFlag(cmd, cfg, &autostart)
+	if err := flags.Parse(args); err != nil {
+		fatalf("failed: %v", err)
+	}
+	m, err := machineForArgs(cfg, flags.Args())
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+
+	vm, err := runningInstance(ctx, cfg, m, autostart)
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	sshArgs, err := vm.SshArgs(ctx)
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	vm.Logger().Debugf("run interactive ssh %v", sshArgs)
+	syscall.Exec("/usr/bin/ssh", append([]string{"ssh"}, sshArgs...), os.Environ())
+}
+
+func runExec(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	var autostart bool
+	flags := bindAutostartFlag(cmd, cfg, &autostart)
+	if err := flags.Parse(args); err != nil {
+		fatalf("failed: %v", err)
+	}
+	// The machine, if any, is separated from the command by --.
+	machineArgs, cmdArgs := []string{}, flags.Args()
+	for i, arg := range cmdArgs {
+		if arg == "--" {
+			machineArgs, cmdArgs = cmdArgs[:i], cmdArgs[i+1:]
+			break
+		}
+	}
+	if len(cmdArgs) == 0 {
+		fatalf("failed: no command given")
+	}
+	m, err := machineForArgs(cfg, machineArgs)
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+
+	vm, err := runningInstance(ctx, cfg, m, autostart)
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	err = vm.Exec(ctx, os.Stdin, os.Stdout, os.Stderr, cmdArgs...)
+	var exitErr *hobo.ExitError
+	if errors.As(err, &exitErr) {
+		hobo.RunCleanups()
+		os.Exit(exitErr.ExitStatus)
+	}
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+}
+
+func runSshConfig(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	var install bool
+	flags := cmd.BindFlagSet(map[string]interface{}{"install": &install})
+	if err := flags.Parse(args); err != nil {
+		fatalf("failed: %v", err)
+	}
+
+	if install {
+		if err := cfg.AppConfig.InstallSshConfig(); err != nil {
+			fatalf("failed installing ssh config: %v", err)
+		}
+		hobo.StdLogger.Infof("Installed hobo ssh config in %s", hobo.UserSshConfigFile())
+		if jsonOutput() {
+			writeJson(sshConfigInstallOutput{
+				SshConfigFile: hobo.UserSshConfigFile(),
+				IncludeFile:   cfg.AppConfig.SshConfigFile(),
+			})
+		}
+		return
+	}
+
+	m, err := machineForArgs(cfg, flags.Args())
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	vm, err := cfg.Instance(m.Key)
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	sc, err := vm.SshConfig(ctx)
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	if jsonOutput() {
+		writeJson(sc)
+		return
+	}
+	fmt.Print(sc.Clause)
+}
+
+var cmdIpAddr = &cmdflag.Command{
+	Name:      "ip-addr",
+	Run:       runIpAddr,
+	UsageLine: "hobo ip-addr [-autostart] [machine]",
+	UsageLong: `Return the current IP address for a VM.
+
+A suspended VM is resumed. With -autostart, a stopped VM is started first.`,
+	Flags: []cmdflag.Flag{
+		{"autostart", cmdflag.FlagTypeBool, false, "Start the VM if it is not running.", nil},
+	},
+}
+
+var cmdSsh = &cmdflag.Command{
+	Name:      "ssh",
+	Run:       runSsh,
+	UsageLine: "hobo ssh [-autostart] [machine]",
+	UsageLong: `SSH into a VM.
+
+A suspended VM is resumed. With -autostart, a stopped VM is started first.`,
+	Flags: []cmdflag.Flag{
+		{"autostart", cmdflag.FlagTypeBool, false, "Start the VM if it is not running.", nil},
+	},
+}
+
+var cmdExec = &cmdflag.Command{
+	Name:      "exec",
+	Run:       runExec,
+	UsageLine: "hobo exec [-autostart] [machine --] command [arg ...]",
+	UsageLong: `Run a command in a VM over ssh and exit with its exit status.
+
+A suspended VM is resumed. With -autostart, a stopped VM is started first.`,
+	Flags: []cmdflag.Flag{
+		{"autostart", cmdflag.FlagTypeBool, false, "Start the VM if it is not running.", nil},
+	},
+}
+
+var cmdSshConfig = &cmdflag.Command{
+	Name:      "ssh-config",
+	Run:       runSshConfig,
+	UsageLine: "hobo ssh-config [-install] [machine]",
+	UsageLong: `Generate an SSH config clause for a VM.
+
+With -install, add a hobo managed block to ~/.ssh/config that includes
+clauses for all VMs. The clauses are kept up to date by start and rm.`,
+	Flags: []cmdflag.Flag{
+		{"install", cmdflag.FlagTypeBool, false, "Maintain clauses for all VMs in ~/.ssh/config.", nil},
+	},
+}
+
+func runRekey(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	m, err := machineForArgs(cfg, args)
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	if err := cfg.Rekey(ctx, m.Key); err != nil {
+		fatalf("failed: %v", err)
+	}
+}
+
+var cmdRekey = &cmdflag.Command{
+	Name:      "rekey",
+	Run:       runRekey,
+	UsageLine: "hobo rekey [machine]",
+	UsageLong: `Rotate the ssh client key for a VM.`,
+}
+
+type sshConfigInstallOutput struct {
+	SshConfigFile string
+	IncludeFile   string
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/msolo/cmdflag"
+	"github.com/msolo/hobo"
+)
+
+// Return the power state along with any transition under way.
+func stateString(st *hobo.InstanceStatus) string {
+	if st.Transition == "" {
+		return st.State
+	}
+	return fmt.Sprintf("%s (%s since %s)", st.State, st.Transition, formatTime(st.TimeStateChanged))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func printInstanceStatus(st *hobo.InstanceStatus) {
+	fmt.Printf("name: %s\n", st.Name)
+	fmt.Printf("state: %s\n", stateString(st))
+	fmt.Printf("vmx: %s\n", st.VmxFile)
+	fmt.Printf("ip-addr: %s\n", st.IpAddr)
+	if st.LiveIpAddr != "" && st.LiveIpAddr != st.IpAddr {
+		fmt.Printf("live-ip-addr: %s (cached address is stale)\n", st.LiveIpAddr)
+	}
+	fmt.Printf("boxcar: %s %s\n", st.Boxcar, st.BoxcarVersion)
+	if st.BootstrapIncomplete {
+		fmt.Printf("bootstrapped: incomplete, run hobo provision -resume\n")
+	} else {
+		fmt.Printf("bootstrapped: %s\n", formatTime(st.TimeBootstrapped))
+	}
+	if st.Uptime > 0 {
+		fmt.Printf("uptime: %s\n", st.Uptime)
+	}
+	for _, du := range st.Disks {
+		fmt.Printf("disk: %s %s\n", du.Name, formatBytes(du.Bytes))
+	}
+	fmt.Printf("project: %s\n", st.ProjectFile)
+}
+
+func runStatus(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	machines, err := cfg.MachinesFor(args)
+	if err != nil {
+		fatalf("failed: %v", err)
+	}
+	dc := daemonClient(cfg)
+	statuses := make([]*hobo.InstanceStatus, 0, len(machines))
+	for _, m := range machines {
+		if dc != nil {
+			st, err := dc.Status(ctx, m.Name)
+			if err != nil {
+				fatalf("failed: %v", err)
+			}
+			statuses = append(statuses, st)
+			continue
+		}
+		st, err := cfg.Status(ctx, m.Key)
+		if err != nil {
+			fatalf("failed: %v", err)
+		}
+		if st.State == hobo.StateRunning {
+			st.InsecureKeyAccepted = cfg.CheckInsecureKey(ctx, m.Key)
+		}
+		statuses = append(statuses, st)
+	}
+
+	if jsonOutput() {
+		writeJson(instancesOutput{Instances: statuses})
+		return
+	}
+	for i, st := range statuses {
+		if i > 0 {
+			fmt.Println()
+		}
+		printInstanceStatus(st)
+	}
+}
+
+var cmdStatus = &cmdflag.Command{
+	Name:      "status",
+	Run:       runStatus,
+	UsageLine: "hobo status [machine ...]",
+	UsageLong: `Show the state of a VM.
+
+This includes the power state, cached and live ip address, boxcar, uptime,
+disk usage and the .hobo file that created it.`,
+}
+
+type instancesOutput struct {
+	Instances []*hobo.InstanceStatus
+}
+
+func sortInstanceStatuses(statuses []*hobo.InstanceStatus, key string) error {
+	var less func(a, b *hobo.InstanceStatus) bool
+	switch key {
+	case "name":
+		less = func(a, b *hobo.InstanceStatus) bool { return a.Name < b.Name }
+	case "size":
+		less = func(a, b *hobo.InstanceStatus) bool { return a.DiskBytes() > b.DiskBytes() }
+	case "used":
+		less = func(a, b *hobo.InstanceStatus) bool { return a.TimeLastUsed.After(b.TimeLastUsed) }
+	default:
+		return fmt.Errorf("invalid sort key %q, expected name, size or used", key)
+	}
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return less(statuses[i], statuses[j])
+	})
+	return nil
+}
+
+func runLs(ctx context.Context, cmd *cmdflag.Command, args []string) {
+	cfg := ctxCfg(ctx)
+	var all bool
+	var state, boxcarName, sortKey string
+	flags := cmd.BindFlagSet(map[string]interface{}{
+		"a":      &all,
+		"state":  &state,
+		"boxcar": &boxcarName,
+		"sort":   &sortKey,
+	})
+	if err := flags.Parse(args); err != nil {
+		fatalf("failed: %v", err)
+	}
+	if !all && state == "" {
+		state = hobo.StateRunning
+	}
+
+	statuses, err := cfg.AppConfig.ListInstances(ctx)
+	if err != nil {
+		fatalf("failed reading vms: %v", err)
+	}
+	if err := sortInstanceStatuses(statuses, sortKey); err != nil {
+		fatalf("failed: %v", err)
+	}
+
+	selected := make([]*hobo.InstanceStatus, 0, len(statuses))
+	for _, st := range statuses {
+		if state != "" && st.State != state && st.Transition != state {
+			continue
+		}
+		if boxcarName != "" && st.Boxcar != boxcarName {
+			continue
+		}
+		selected = append(selected, st)
+	}
+
+	if jsonOutput() {
+		writeJson(instancesOutput{Instances: selected})
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, st := range selected {
+		flag := ""
+		if st.Orphan {
+			flag = "orphan"
+		}
+		shownState := st.State
+		if st.Transition != "" {
+			shownState += " (" + st.Transition + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", st.Name, shownState,
+			formatBytes(st.DiskBytes()), formatTime(st.TimeLastUsed), st.Boxcar, st.VmxFile, flag)
+	}
+	tw.Flush()
+}
+
+var cmdLs = &cmdflag.Command{
+	Name:      "ls",
+	Run:       runLs,
+	UsageLine: "hobo ls [-a] [-state state] [-boxcar name] [-sort name|size|used]",
+	UsageLong: `Show running VMs, or all VMs with -a.
+
+VMs with a vmx file but no hobo config are flagged as orphans. These are
+left behind by a failed clone and can be removed with rm.`,
+	Flags: []cmdflag.Flag{
+		{"a", cmdflag.FlagTypeBool, false, "Show all VMs, not just running ones.", nil},
+		{"state", cmdflag.FlagTypeString, "", "Only show VMs in this state.",
+			cmdflag.PredictSet(hobo.StateRunning, hobo.StateSuspended, hobo.StateStopped, hobo.StatePartialClone)},
+		{"boxcar", cmdflag.FlagTypeString, "", "Only show VMs cloned from this boxcar.", nil},
+		{"sort", cmdflag.FlagTypeString, "name", "Sort by name, size or used.", cmdflag.PredictSet("name", "size", "used")},
+	},
+}
@@ -0,0 +1,604 @@
+package hobo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The daemon serves a small json api over a unix socket in HoboDir:
+//
+//   GET  /ping                    - {"Pid": ...}
+//   GET  /instances               - every instance, like ls -a
+//   GET  /instances/NAME          - status of one instance
+//   POST /instances/NAME/start    - {"ConfigFile": ..., "Machine": ...}
+//   POST /instances/NAME/stop     - {"Hard": true}
+//   POST /instances/NAME/suspend
+//   POST /instances/NAME/resume   - like start
+//   POST /instances/NAME/restart
+//   POST /instances/NAME/exec     - {"Args": [...], "Stdin": ...}
+//   GET  /events                  - server-sent events as states change
+//
+// Errors are returned as {"Error": ...}. Operations on the same instance
+// are serialised, operations on different instances run concurrently. The
+// daemon also suspends idle instances, like hobo watch.
+
+// How often the daemon polls vmrun for state changes made outside of it.
+const daemonPollInterval = 2 * time.Second
+
+func (ac *AppConfig) daemonSocket() string {
+	return path.Join(ac.HoboDir, "hobo.sock")
+}
+
+type pingOutput struct {
+	Pid int
+}
+
+type startRequest struct {
+	// ConfigFile is the .hobo file for the instance. It defaults to the
+	// file that created it.
+	ConfigFile string
+	Machine    string
+}
+
+type stopRequest struct {
+	Hard bool
+}
+
+type execRequest struct {
+	Args  []string
+	Stdin string
+}
+
+type instancesOutput struct {
+	Instances []*InstanceStatus
+}
+
+type errorOutput struct {
+	Error string
+}
+
+type execOutput struct {
+	Stdout     string
+	Stderr     string
+	ExitStatus int
+}
+
+// A stateEvent is sent on /events when an instance changes state. On
+// connect, the current state of every instance is sent with an empty
+// PrevState.
+type stateEvent struct {
+	Name      string
+	State     string
+	PrevState string
+	Time      time.Time
+}
+
+type daemon struct {
+	ac AppConfig
+
+	locksMu sync.Mutex
+	locks   map[string]*sync.Mutex
+
+	stateMu sync.Mutex
+	states  map[string]string
+	subs    map[chan stateEvent]bool
+}
+
+func newDaemon(ac AppConfig) *daemon {
+	return &daemon{
+		ac:     ac,
+		locks:  make(map[string]*sync.Mutex),
+		states: make(map[string]string),
+		subs:   make(map[chan stateEvent]bool),
+	}
+}
+
+// Lock the named instance and return the unlock func.
+func (d *daemon) lock(name string) func() {
+	d.locksMu.Lock()
+	mu, ok := d.locks[name]
+	if !ok {
+		mu = &sync.Mutex{}
+		d.locks[name] = mu
+	}
+	d.locksMu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// Refresh the known states and notify subscribers of any changes.
+func (d *daemon) poll(ctx context.Context) {
+	statuses, err := d.ac.ListInstances(ctx)
+	if err != nil {
+		StdLogger.Warnf("unable to list instances: %v", err)
+		return
+	}
+	now := time.Now()
+	seen := make(map[string]bool, len(statuses))
+	events := make([]stateEvent, 0, 4)
+
+	d.stateMu.Lock()
+	for _, st := range statuses {
+		seen[st.Name] = true
+		if prev := d.states[st.Name]; prev != st.State {
+			events = append(events, stateEvent{Name: st.Name, State: st.State, PrevState: prev, Time: now})
+			d.states[st.Name] = st.State
+		}
+	}
+	for name, prev := range d.states {
+		if !seen[name] {
+			events = append(events, stateEvent{Name: name, State: "removed", PrevState: prev, Time: now})
+			delete(d.states, name)
+		}
+	}
+	for _, ev := range events {
+		for c := range d.subs {
+			select {
+			case c <- ev:
+			default:
+				// A slow subscriber misses events rather than stalling
+				// everyone else.
+			}
+		}
+	}
+	d.stateMu.Unlock()
+}
+
+func (d *daemon) watch(ctx context.Context) {
+	for {
+		d.poll(ctx)
+		select {
+		case <-time.After(daemonPollInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Subscribe to state changes. The current states are queued first.
+func (d *daemon) subscribe() (c chan stateEvent, cancel func()) {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	c = make(chan stateEvent, 64+len(d.states))
+	now := time.Now()
+	for name, state := range d.states {
+		c <- stateEvent{Name: name, State: state, Time: now}
+	}
+	d.subs[c] = true
+	return c, func() {
+		d.stateMu.Lock()
+		defer d.stateMu.Unlock()
+		delete(d.subs, c)
+	}
+}
+
+func writeHttpJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	data, _ := json.MarshalIndent(v, "", "  ")
+	w.Write(append(data, '\n'))
+}
+
+func writeHttpError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, errBadRequest):
+		code = http.StatusBadRequest
+	}
+	writeHttpJson(w, code, errorOutput{Error: Redact(err.Error())})
+}
+
+var errBadRequest = errors.New("bad request")
+
+func readHttpJson(r *http.Request, v interface{}) error {
+	if r.ContentLength == 0 {
+		return nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return nil
+}
+
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/ping":
+		writeHttpJson(w, http.StatusOK, pingOutput{Pid: os.Getpid()})
+	case r.Method == "GET" && r.URL.Path == "/events":
+		d.serveEvents(w, r)
+	case r.Method == "GET" && r.URL.Path == "/instances":
+		statuses, err := d.ac.ListInstances(r.Context())
+		if err != nil {
+			writeHttpError(w, err)
+			return
+		}
+		writeHttpJson(w, http.StatusOK, instancesOutput{Instances: statuses})
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "instances":
+		st, err := d.status(r.Context(), parts[1])
+		if err != nil {
+			writeHttpError(w, err)
+			return
+		}
+		writeHttpJson(w, http.StatusOK, st)
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "instances":
+		v, err := d.operate(r, parts[1], parts[2])
+		// Let subscribers see the effect of the operation right away.
+		d.poll(r.Context())
+		if err != nil {
+			writeHttpError(w, err)
+			return
+		}
+		writeHttpJson(w, http.StatusOK, v)
+	default:
+		writeHttpJson(w, http.StatusNotFound, errorOutput{Error: "no such endpoint: " + r.Method + " " + r.URL.Path})
+	}
+}
+
+func (d *daemon) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeHttpError(w, errors.New("streaming not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	c, cancel := d.subscribe()
+	defer cancel()
+	for {
+		select {
+		case ev := <-c:
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: state\ndata: %s\n\n", data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (d *daemon) readInstance(name string) (*Instance, error) {
+	vm, err := readInstanceForName(d.ac, name)
+	if os.IsNotExist(err) {
+		return nil, opError("read", name, ErrNotFound)
+	}
+	return vm, opError("read", name, err)
+}
+
+func (d *daemon) status(ctx context.Context, name string) (*InstanceStatus, error) {
+	vm, err := readInstanceForStatus(d.ac, name)
+	if err != nil {
+		return nil, opError("status", name, err)
+	}
+	running, err := getRunningVmxSet(ctx, &d.ac)
+	if err != nil {
+		return nil, opError("status", name, err)
+	}
+	st, err := vm.status(running, true)
+	if err != nil {
+		return nil, opError("status", name, err)
+	}
+	if st.State == StateRunning {
+		st.InsecureKeyAccepted = checkInsecureKey(ctx, &d.ac, vm)
+	}
+	return st, nil
+}
+
+func (d *daemon) operate(r *http.Request, name, op string) (interface{}, error) {
+	ctx := r.Context()
+	unlock := d.lock(name)
+	defer unlock()
+
+	switch op {
+	case "start":
+		req := startRequest{}
+		if err := readHttpJson(r, &req); err != nil {
+			return nil, err
+		}
+		// Cloning bootstraps the guest, which reads the caller's environment
+		// and identity and streams output to the caller, so the client does
+		// that itself rather than sending it here.
+		if _, err := d.readInstance(name); err != nil {
+			return nil, err
+		}
+		cfg, key, err := d.configForInstance(name, req)
+		if err != nil {
+			return nil, opError("start", name, err)
+		}
+		if _, err := cfg.Start(ctx, key); err != nil {
+			return nil, err
+		}
+		return d.status(ctx, name)
+	case "stop":
+		req := stopRequest{}
+		if err := readHttpJson(r, &req); err != nil {
+			return nil, err
+		}
+		vm, err := d.readInstance(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := stopInstance(ctx, vm, req.Hard); err != nil {
+			return nil, opError("stop", name, err)
+		}
+		return d.status(ctx, name)
+	case "resume":
+		req := startRequest{}
+		if err := readHttpJson(r, &req); err != nil {
+			return nil, err
+		}
+		cfg, key, err := d.configForInstance(name, req)
+		if err != nil {
+			return nil, opError("resume", name, err)
+		}
+		if _, err := cfg.Resume(ctx, key); err != nil {
+			return nil, err
+		}
+		return d.status(ctx, name)
+	case "restart":
+		vm, err := d.readInstance(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := restartInstance(ctx, vm); err != nil {
+			return nil, opError("restart", name, err)
+		}
+		return d.status(ctx, name)
+	case "suspend":
+		vm, err := d.readInstance(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := suspendInstance(ctx, vm); err != nil {
+			return nil, opError("suspend", name, err)
+		}
+		return d.status(ctx, name)
+	case "exec":
+		req := execRequest{}
+		if err := readHttpJson(r, &req); err != nil {
+			return nil, err
+		}
+		if len(req.Args) == 0 {
+			return nil, fmt.Errorf("%w: no command", errBadRequest)
+		}
+		vm, err := d.readInstance(name)
+		if err != nil {
+			return nil, err
+		}
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		err = vm.Exec(ctx, strings.NewReader(req.Stdin), stdout, stderr, req.Args...)
+		out := &execOutput{Stdout: stdout.String(), Stderr: stderr.String()}
+		var exitErr *ExitError
+		if errors.As(err, &exitErr) {
+			out.ExitStatus = exitErr.ExitStatus
+		} else if err != nil {
+			return nil, err
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%w: unknown operation %q", errBadRequest, op)
+}
+
+// Load the .hobo file for an instance and find its machine key. The file
+// must use the same HoboDir as the daemon.
+func (d *daemon) configForInstance(name string, req startRequest) (*Config, string, error) {
+	if req.ConfigFile == "" {
+		vm, err := d.readInstance(name)
+		if err != nil {
+			return nil, "", err
+		}
+		if vm.vmConfig.ProjectFile == "" {
+			return nil, "", fmt.Errorf("%w: no ConfigFile given and the instance has no project file", errBadRequest)
+		}
+		req.ConfigFile = vm.vmConfig.ProjectFile
+	}
+	cfg, err := LoadConfig(req.ConfigFile)
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.AppConfig.HoboDir != d.ac.HoboDir {
+		return nil, "", fmt.Errorf("%w: %s uses HoboDir %s, the daemon serves %s",
+			errBadRequest, req.ConfigFile, cfg.AppConfig.HoboDir, d.ac.HoboDir)
+	}
+	for _, m := range cfg.machines() {
+		if m.Name == name && (req.Machine == "" || req.Machine == m.Key) {
+			return cfg, m.Key, nil
+		}
+	}
+	return nil, "", fmt.Errorf("%w: %s does not define instance %s", errBadRequest, req.ConfigFile, name)
+}
+
+// A DaemonClient sends operations to a running daemon, so they are
+// serialised with everything else it does. Start and Resume take a machine
+// key like the operations on Config, the others take an instance name.
+type DaemonClient struct {
+	client *http.Client
+}
+
+// Return a client for the daemon, or nil if it isn't running.
+func (ac *AppConfig) DaemonClient() *DaemonClient {
+	sock := ac.daemonSocket()
+	if _, err := os.Stat(sock); err != nil {
+		return nil
+	}
+	dc := &DaemonClient{client: &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+			},
+		},
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := dc.do(ctx, "GET", "/ping", nil, &pingOutput{}); err != nil {
+		return nil
+	}
+	return dc
+}
+
+func (dc *DaemonClient) do(ctx context.Context, method, urlPath string, req, resp interface{}) error {
+	var body io.Reader
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	hreq, err := http.NewRequest(method, "http://hobo"+urlPath, body)
+	if err != nil {
+		return err
+	}
+	hresp, err := dc.client.Do(hreq.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer hresp.Body.Close()
+	if hresp.StatusCode != http.StatusOK {
+		out := errorOutput{}
+		if err := json.NewDecoder(hresp.Body).Decode(&out); err != nil || out.Error == "" {
+			return fmt.Errorf("daemon returned status %d", hresp.StatusCode)
+		}
+		if hresp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%w: %s", ErrNotFound, out.Error)
+		}
+		return errors.New(out.Error)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(hresp.Body).Decode(resp)
+}
+
+// Return the status of an instance, as Config.Status does.
+func (dc *DaemonClient) Status(ctx context.Context, name string) (*InstanceStatus, error) {
+	st := &InstanceStatus{}
+	if err := dc.do(ctx, "GET", "/instances/"+name, nil, st); err != nil {
+		return nil, err
+	}
+	st.Uptime = time.Duration(st.UptimeSeconds) * time.Second
+	return st, nil
+}
+
+func newStartRequest(cfg *Config, m *Machine) (startRequest, error) {
+	req := startRequest{Machine: m.Key}
+	if cfg.configFile != "" {
+		fname, err := filepath.Abs(cfg.configFile)
+		if err != nil {
+			return req, err
+		}
+		req.ConfigFile = fname
+	}
+	return req, nil
+}
+
+// Start the instance for a machine with the daemon. An instance that doesn't
+// exist yet is fetched, cloned and bootstrapped here instead, since bootstrap
+// reads this process's environment and host identity and logs the step
+// output here.
+func (dc *DaemonClient) Start(ctx context.Context, cfg *Config, key string) error {
+	m, err := cfg.Machine(key)
+	if err != nil {
+		return opError("start", key, err)
+	}
+	if _, err := readInstanceForName(cfg.AppConfig, m.Name); os.IsNotExist(err) {
+		_, err := cfg.Start(ctx, m.Key)
+		return err
+	}
+	req, err := newStartRequest(cfg, m)
+	if err != nil {
+		return err
+	}
+	StdLogger.Infof("Starting %s with hobo daemon", m.Name)
+	return dc.do(ctx, "POST", "/instances/"+m.Name+"/start", req, nil)
+}
+
+// Resume the suspended instance for a machine with the daemon.
+func (dc *DaemonClient) Resume(ctx context.Context, cfg *Config, key string) error {
+	m, err := cfg.Machine(key)
+	if err != nil {
+		return opError("resume", key, err)
+	}
+	req, err := newStartRequest(cfg, m)
+	if err != nil {
+		return err
+	}
+	StdLogger.Infof("Resuming %s with hobo daemon", m.Name)
+	return dc.do(ctx, "POST", "/instances/"+m.Name+"/resume", req, nil)
+}
+
+// Reboot a running instance with the daemon.
+func (dc *DaemonClient) Restart(ctx context.Context, name string) error {
+	StdLogger.Infof("Restarting %s with hobo daemon", name)
+	return dc.do(ctx, "POST", "/instances/"+name+"/restart", nil, nil)
+}
+
+// Stop an instance with the daemon.
+func (dc *DaemonClient) Stop(ctx context.Context, name string, hard bool) error {
+	return dc.do(ctx, "POST", "/instances/"+name+"/stop", stopRequest{Hard: hard}, nil)
+}
+
+// Suspend an instance with the daemon.
+func (dc *DaemonClient) Suspend(ctx context.Context, name string) error {
+	return dc.do(ctx, "POST", "/instances/"+name+"/suspend", nil, nil)
+}
+
+// Serve the daemon api on the socket in HoboDir until ctx is done. The
+// daemon also suspends idle instances.
+func (ac *AppConfig) ServeDaemon(ctx context.Context) error {
+	if dc := ac.DaemonClient(); dc != nil {
+		return fmt.Errorf("daemon already running on %s", ac.daemonSocket())
+	}
+	if err := os.MkdirAll(ac.HoboDir, 0755); err != nil {
+		return err
+	}
+	// Nothing answered on the socket, so it is left over from a daemon that
+	// died.
+	sock := ac.daemonSocket()
+	if err := os.Remove(sock); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed removing stale socket: %v", err)
+	}
+	// The socket must never be reachable by other users, even between being
+	// created and a chmod, so it is created with only owner permissions.
+	oldUmask := syscall.Umask(0077)
+	l, err := net.Listen("unix", sock)
+	syscall.Umask(oldUmask)
+	if err != nil {
+		return err
+	}
+	removeSock := func() { os.Remove(sock) }
+	defer addCleanup(removeSock)()
+	defer removeSock()
+
+	d := newDaemon(*ac)
+	srv := &http.Server{Handler: d}
+	go d.watch(ctx)
+	go newIdleWatcher(*ac, d.lock).watch(ctx)
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	StdLogger.Infof("Serving on %s", sock)
+	if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
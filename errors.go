@@ -0,0 +1,59 @@
+package hobo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the operations on Config and Instance. They are usually
+// wrapped in an *Error, so test for them with errors.Is.
+var (
+	ErrNotFound            = errors.New("instance not found")
+	ErrExists              = errors.New("instance already exists")
+	ErrNotRunning          = errors.New("instance not running")
+	ErrChecksumMismatch    = errors.New("boxcar checksum mismatch")
+	ErrInvalidBoxcar       = errors.New("invalid boxcar")
+	ErrSshTimeout          = errors.New("timed out waiting for ssh")
+	ErrInsecureKeyAccepted = errors.New("guest still accepts the insecure bootstrap key")
+	ErrBootstrapFailed     = errors.New("bootstrap failed")
+	ErrInvalidState        = errors.New("invalid instance state")
+	ErrNoIpAddr            = errors.New("no ip address found")
+)
+
+// An Error records the operation and instance that failed.
+type Error struct {
+	Op       string
+	Instance string
+	Err      error
+}
+
+func (e *Error) Error() string {
+	if e.Instance == "" {
+		return e.Op + ": " + e.Err.Error()
+	}
+	return e.Op + " " + e.Instance + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func opError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return &Error{Op: op, Instance: name, Err: err}
+}
+
+// An ExitError is returned by Exec when the remote command exits non-zero.
+type ExitError struct {
+	Args       []string
+	ExitStatus int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command %v exited with status %d", e.Args, e.ExitStatus)
+}
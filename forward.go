@@ -0,0 +1,413 @@
+package hobo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A Forward maps a TCP port on the host to a port inside the guest. The
+// tunnels are carried over ssh, so the guest only needs sshd listening.
+type Forward struct {
+	HostPort  int
+	GuestPort int
+	// BindAddr is the host address to listen on, 127.0.0.1 if empty.
+	BindAddr string
+	// Adhoc forwards were added with `hobo forward add` rather than declared
+	// in the .hobo file.
+	Adhoc bool `json:",omitempty"`
+}
+
+func (fw Forward) bindAddr() string {
+	if fw.BindAddr == "" {
+		return "127.0.0.1"
+	}
+	return fw.BindAddr
+}
+
+func (fw Forward) hostAddr() string {
+	return net.JoinHostPort(fw.bindAddr(), strconv.Itoa(fw.HostPort))
+}
+
+func (fw Forward) sshArg() string {
+	return fmt.Sprintf("%s:127.0.0.1:%d", fw.hostAddr(), fw.GuestPort)
+}
+
+func (fw Forward) String() string {
+	return fmt.Sprintf("%s -> guest:%d", fw.hostAddr(), fw.GuestPort)
+}
+
+// Parse a forward spec of the form [bind_addr:]host_port:guest_port. An
+// IPv6 bind_addr is written in brackets, as in [::1]:8080:80.
+func parseForward(spec string) (Forward, error) {
+	fw := Forward{}
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return fw, fmt.Errorf("invalid forward spec %q, expected [bind_addr:]host_port:guest_port", spec)
+	}
+	hostPort, guestPort := spec[:i], spec[i+1:]
+	if strings.Contains(hostPort, ":") {
+		var err error
+		if fw.BindAddr, hostPort, err = net.SplitHostPort(hostPort); err != nil {
+			return fw, fmt.Errorf("invalid forward spec %q: %v", spec, err)
+		}
+	}
+	var err error
+	if fw.HostPort, err = parsePort(hostPort); err != nil {
+		return fw, err
+	}
+	if fw.GuestPort, err = parsePort(guestPort); err != nil {
+		return fw, err
+	}
+	return fw, nil
+}
+
+// Parse the host address of a forward spec, [bind_addr:]host_port, into the
+// form hostAddr returns.
+func parseForwardHostAddr(spec string) (string, error) {
+	fw, err := parseForward(spec + ":1")
+	if err != nil {
+		return "", err
+	}
+	return fw.hostAddr(), nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port: %q", s)
+	}
+	return port, nil
+}
+
+// Return an error if something else on the host is already listening on
+// the forward's host address.
+func checkHostPort(fw Forward) error {
+	ln, err := net.Listen("tcp", fw.hostAddr())
+	if err != nil {
+		return fmt.Errorf("host port conflict on %s: %v", fw.hostAddr(), err)
+	}
+	return ln.Close()
+}
+
+// Return an error if two forwards in the list claim the same host address.
+func checkDuplicateForwards(fwds []Forward) error {
+	seen := make(map[string]bool, len(fwds))
+	for _, fw := range fwds {
+		if seen[fw.hostAddr()] {
+			return fmt.Errorf("duplicate forward for host address %s", fw.hostAddr())
+		}
+		seen[fw.hostAddr()] = true
+	}
+	return nil
+}
+
+func (vm *Instance) forwardsFile() string {
+	return path.Join(vm.vmConfig.vmPath, "hobo/forwards.json")
+}
+
+func (vm *Instance) forwardPidFile() string {
+	return path.Join(vm.vmConfig.vmPath, "hobo/forward.pid")
+}
+
+// The lock serializing changes to the forwards file and the supervisor.
+func (vm *Instance) forwardLockFile() string {
+	return path.Join(vm.vmConfig.vmPath, "hobo/forward.lock")
+}
+
+func (vm *Instance) forwardLogFile() string {
+	return path.Join(vm.vmConfig.vmPath, "hobo/forward.log")
+}
+
+func (vm *Instance) readForwards() ([]Forward, error) {
+	data, err := ioutil.ReadFile(vm.forwardsFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	fwds := make([]Forward, 0, 4)
+	if err := json.Unmarshal(data, &fwds); err != nil {
+		return nil, err
+	}
+	return fwds, nil
+}
+
+func (vm *Instance) writeForwards(fwds []Forward) error {
+	data, err := json.MarshalIndent(fwds, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(vm.forwardsFile(), data, 0644)
+}
+
+// Return the pid of the forward supervisor, or 0 if it is not running.
+func (vm *Instance) forwardSupervisorPid() int {
+	data, err := ioutil.ReadFile(vm.forwardPidFile())
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	if err := syscall.Kill(pid, 0); err != nil {
+		return 0
+	}
+	return pid
+}
+
+// Replace the declared forwards with fwds, keeping any adhoc forwards, and
+// make sure the supervisor is running with the merged list.
+func (vm *Instance) startForwarding(ctx context.Context, configFile, machineKey string, fwds []Forward) error {
+	return vm.updateForwards(ctx, configFile, machineKey, func(current []Forward) ([]Forward, error) {
+		merged := make([]Forward, 0, len(fwds)+len(current))
+		for _, fw := range fwds {
+			fw.Adhoc = false
+			merged = append(merged, fw)
+		}
+		for _, fw := range current {
+			if fw.Adhoc {
+				merged = append(merged, fw)
+			}
+		}
+		return merged, nil
+	})
+}
+
+// Replace the forwards with those fn returns from the current ones and
+// bring the supervisor in line with them. This is serialized with other
+// hobo commands, so concurrent changes are not lost and only one
+// supervisor is ever started.
+func (vm *Instance) updateForwards(ctx context.Context, configFile, machineKey string, fn func(current []Forward) ([]Forward, error)) error {
+	if err := os.MkdirAll(path.Dir(vm.forwardLockFile()), 0755); err != nil {
+		return err
+	}
+	unlock, err := lockFile(vm.forwardLockFile(), true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	current, err := vm.readForwards()
+	if err != nil {
+		return err
+	}
+	fwds, err := fn(current)
+	if err != nil {
+		return err
+	}
+	return vm.applyForwards(ctx, configFile, machineKey, current, fwds)
+}
+
+// Persist fwds and bring the supervisor in line with them. Only host ports
+// that are not already held by our own supervisor are checked for conflicts.
+func (vm *Instance) applyForwards(ctx context.Context, configFile, machineKey string, current, fwds []Forward) error {
+	if err := checkDuplicateForwards(fwds); err != nil {
+		return err
+	}
+	pid := vm.forwardSupervisorPid()
+	held := make(map[string]bool, len(current))
+	if pid != 0 {
+		for _, fw := range current {
+			held[fw.hostAddr()] = true
+		}
+	}
+	for _, fw := range fwds {
+		if held[fw.hostAddr()] {
+			continue
+		}
+		if err := checkHostPort(fw); err != nil {
+			return err
+		}
+	}
+	if err := vm.writeForwards(fwds); err != nil {
+		return err
+	}
+
+	if len(fwds) == 0 {
+		return vm.stopForwarding()
+	}
+	if pid != 0 {
+		// Ask the supervisor to reload the forwards file.
+		return syscall.Kill(pid, syscall.SIGHUP)
+	}
+	return vm.spawnForwardSupervisor(ctx, configFile, machineKey)
+}
+
+// How long a new supervisor has to write its pid file.
+const forwardSupervisorStartTimeout = 5 * time.Second
+
+// Start the supervisor as a detached process so it outlives this command,
+// and wait for it to write its pid file. Until then it can't take a SIGHUP,
+// and the next command would start a second supervisor.
+func (vm *Instance) spawnForwardSupervisor(ctx context.Context, configFile, machineKey string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	configFile, err = filepath.Abs(configFile)
+	if err != nil {
+		return err
+	}
+	flog, err := os.OpenFile(vm.forwardLogFile(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer flog.Close()
+
+	args := []string{"-config-file", configFile, "forward", "supervise"}
+	if machineKey != "" {
+		args = append(args, machineKey)
+	}
+	// Not exec.CommandContext, which would kill the supervisor when ctx is
+	// done. ctx only bounds the wait for it to start.
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = flog
+	cmd.Stderr = flog
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+	exitC := make(chan error, 1)
+	go func() {
+		exitC <- cmd.Wait()
+	}()
+
+	startCtx, cancel := context.WithTimeout(ctx, forwardSupervisorStartTimeout)
+	defer cancel()
+	for vm.forwardSupervisorPid() != pid {
+		select {
+		case err := <-exitC:
+			return fmt.Errorf("forward supervisor exited: %v, see %s", err, vm.forwardLogFile())
+		case <-startCtx.Done():
+			cmd.Process.Kill()
+			return fmt.Errorf("forward supervisor %d did not start: %v", pid, startCtx.Err())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	vm.Logger().Infof("Forwarding ports, supervisor pid %d", pid)
+	return nil
+}
+
+// Stop the supervisor and forget any adhoc forwards. The declared forwards
+// are rewritten on the next start.
+func (vm *Instance) teardownForwarding() error {
+	if err := vm.stopForwarding(); err != nil {
+		return err
+	}
+	if err := os.Remove(vm.forwardsFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Stop the supervisor and all of its tunnels. This is not an error if
+// nothing is running.
+func (vm *Instance) stopForwarding() error {
+	pid := vm.forwardSupervisorPid()
+	if pid == 0 {
+		return nil
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if syscall.Kill(pid, 0) != nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("forward supervisor %d did not exit", pid)
+}
+
+// Run a single ssh process carrying all the tunnels, restarting it when it
+// dies and reloading the forwards file on SIGHUP. This runs until SIGTERM.
+func (vm *Instance) superviseForwards(ctx context.Context) error {
+	// The pid file tells the parent the signal handlers are in place.
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	if err := writeFileAtomic(vm.forwardPidFile(), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(vm.forwardPidFile())
+
+	backoff := time.Second
+	for {
+		fwds, err := vm.readForwards()
+		if err != nil {
+			return err
+		}
+		if len(fwds) == 0 {
+			vm.Logger().Infof("no forwards, exiting")
+			return nil
+		}
+		ipAddr, err := vm.getIpAddr(ctx)
+		if err != nil {
+			return err
+		}
+
+		args := vm.sshCmdArgs()
+		args = append(args, "-i", vm.vmConfig.sshId, "-N",
+			"-oExitOnForwardFailure=yes", "-oServerAliveInterval=15")
+		for _, fw := range fwds {
+			args = append(args, "-L", fw.sshArg())
+		}
+		args = append(args, "hobo@"+ipAddr)
+
+		sshCtx, cancel := context.WithCancel(ctx)
+		cmd := exec.CommandContext(sshCtx, "/usr/bin/ssh", args[1:]...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		vm.Logger().Infof("forwarding %d ports to %s", len(fwds), ipAddr)
+		vm.Logger().Debugf("run %v", cmd.Args)
+		started := time.Now()
+		if err := cmd.Start(); err != nil {
+			cancel()
+			return err
+		}
+		exitC := make(chan error, 1)
+		go func() {
+			exitC <- cmd.Wait()
+		}()
+
+		select {
+		case sig := <-sigC:
+			cancel()
+			<-exitC
+			if sig != syscall.SIGHUP {
+				return nil
+			}
+			backoff = time.Second
+			vm.Logger().Infof("reloading forwards")
+		case err := <-exitC:
+			cancel()
+			if time.Since(started) > time.Minute {
+				backoff = time.Second
+			}
+			vm.Logger().Warnf("ssh exited: %v, restarting in %v", err, backoff)
+			select {
+			case sig := <-sigC:
+				if sig != syscall.SIGHUP {
+					return nil
+				}
+			case <-time.After(backoff):
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package hobo
+
+import "testing"
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Forward
+		wantErr bool
+	}{
+		{"8080:80", Forward{HostPort: 8080, GuestPort: 80}, false},
+		{"0.0.0.0:8080:80", Forward{HostPort: 8080, GuestPort: 80, BindAddr: "0.0.0.0"}, false},
+		{"[::1]:8080:80", Forward{HostPort: 8080, GuestPort: 80, BindAddr: "::1"}, false},
+		{"localhost:1:65535", Forward{HostPort: 1, GuestPort: 65535, BindAddr: "localhost"}, false},
+		{"8080", Forward{}, true},
+		{"", Forward{}, true},
+		{"8080:", Forward{}, true},
+		{":80", Forward{}, true},
+		{"0:80", Forward{}, true},
+		{"8080:65536", Forward{}, true},
+		{"http:80", Forward{}, true},
+		{"::1:8080:80", Forward{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseForward(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseForward(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseForward(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseForwardHostAddr(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{"8080", "127.0.0.1:8080", false},
+		{"0.0.0.0:8080", "0.0.0.0:8080", false},
+		{"[::1]:8080", "[::1]:8080", false},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseForwardHostAddr(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseForwardHostAddr(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseForwardHostAddr(%q) = %q, want %q", tt.spec, got, tt.want)
+		}
+	}
+}
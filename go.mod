@@ -1,4 +1,4 @@
-module hobo
+module github.com/msolo/hobo
 
 require github.com/msolo/cmdflag v0.0.0-20181212085438-c9ab3612cb92
 
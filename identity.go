@@ -0,0 +1,232 @@
+package hobo
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// A HostIdentity selects what of the host user's identity is copied into
+// the guest during bootstrap. Everything is off by default.
+type HostIdentity struct {
+	// PublicKeys adds ~/.ssh/*.pub to the hobo user's authorized_keys.
+	PublicKeys bool
+	// Git sets the global git user.name and user.email.
+	Git bool
+	// Timezone sets the guest timezone to the host's.
+	Timezone bool
+	// Locale sets the guest LANG to the host's.
+	Locale bool
+	// Proxy exports the host's proxy variables from /etc/profile.d.
+	Proxy bool
+	// User creates a guest user with the host username, uid and gid, with
+	// the same authorized_keys and passwordless sudo as the hobo user.
+	User bool
+}
+
+// The name of the step that copies the host identity.
+const hostIdentityStepName = "host-identity"
+
+// The proxy variables copied by Proxy, in both the cases tools look for.
+var proxyEnvNames = []string{
+	"http_proxy", "https_proxy", "ftp_proxy", "no_proxy",
+	"HTTP_PROXY", "HTTPS_PROXY", "FTP_PROXY", "NO_PROXY",
+}
+
+func (hi HostIdentity) enabled() bool {
+	return hi.PublicKeys || hi.Git || hi.Timezone || hi.Locale || hi.Proxy || hi.User
+}
+
+// Return the host timezone name, from TZ or the /etc/localtime symlink.
+func hostTimezone() string {
+	if tz := strings.TrimPrefix(os.Getenv("TZ"), ":"); tz != "" && !filepath.IsAbs(tz) {
+		return tz
+	}
+	target, err := os.Readlink("/etc/localtime")
+	if err != nil {
+		return ""
+	}
+	if i := strings.Index(target, "zoneinfo/"); i >= 0 {
+		return target[i+len("zoneinfo/"):]
+	}
+	return ""
+}
+
+// Return the host locale, as the shell would pick it.
+func hostLocale() string {
+	for _, name := range []string{"LC_ALL", "LANG"} {
+		if v := os.Getenv(name); v != "" && v != "C" && v != "POSIX" {
+			return v
+		}
+	}
+	return ""
+}
+
+func hostGitConfig(ctx context.Context, key string) string {
+	out, err := exec.CommandContext(ctx, "git", "config", "--get", key).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Return the host user's public keys, one per line.
+func hostPublicKeys() ([]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	fnames, err := filepath.Glob(filepath.Join(home, ".ssh", "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(fnames))
+	for _, fname := range fnames {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				keys = append(keys, line)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Return the command lines that copy the selected parts of the host
+// identity. The host values are read now and written into the commands, so
+// the step hash changes along with them and provision -changed reapplies
+// them. Values the host doesn't have are left alone in the guest.
+func (hi HostIdentity) cmdLines(ctx context.Context) ([]string, error) {
+	lines := make([]string, 0, 16)
+	if hi.PublicKeys {
+		keys, err := hostPublicKeys()
+		if err != nil {
+			return nil, fmt.Errorf("HostIdentity.PublicKeys: %v", err)
+		}
+		lines = append(lines, "mkdir -p -m 700 ~/.ssh && touch ~/.ssh/authorized_keys")
+		for _, key := range keys {
+			q := shellQuote(key)
+			lines = append(lines, "grep -qxF "+q+" ~/.ssh/authorized_keys || echo "+q+" >> ~/.ssh/authorized_keys")
+		}
+	}
+
+	var gitCmds []string
+	if hi.Git {
+		for _, key := range []string{"user.name", "user.email"} {
+			if v := hostGitConfig(ctx, key); v != "" {
+				gitCmds = append(gitCmds, "git config --global "+key+" "+shellQuote(v))
+			}
+		}
+		for _, c := range gitCmds {
+			lines = append(lines, "if command -v git >/dev/null; then "+c+"; fi")
+		}
+	}
+
+	if tz := hostTimezone(); hi.Timezone && tz != "" {
+		q := shellQuote(tz)
+		lines = append(lines,
+			"sudo timedatectl set-timezone "+q+" 2>/dev/null || sudo ln -sf /usr/share/zoneinfo/"+q+" /etc/localtime")
+	}
+
+	if lang := hostLocale(); hi.Locale && lang != "" {
+		q := shellQuote(lang)
+		lines = append(lines,
+			"if command -v locale-gen >/dev/null; then sudo locale-gen "+q+" >/dev/null; fi",
+			"sudo localectl set-locale LANG="+q+" 2>/dev/null || echo LANG="+q+" | sudo tee /etc/default/locale >/dev/null")
+	}
+
+	if hi.Proxy {
+		// Proxy URLs can carry credentials, so the values are redacted and
+		// the file is only readable by root and the hobo user's group. The
+		// User user joins that group below.
+		exports := make([]string, 0, len(proxyEnvNames))
+		for _, name := range proxyEnvNames {
+			if v := os.Getenv(name); v != "" {
+				addRedaction(v)
+				exports = append(exports, shellQuote("export "+name+"="+shellQuote(v)))
+			}
+		}
+		if len(exports) > 0 {
+			lines = append(lines, "printf '%s\\n' "+strings.Join(exports, " ")+
+				` | sudo install -m 0640 -g "$(id -g)" /dev/stdin /etc/profile.d/hobo-proxy.sh`)
+		} else {
+			lines = append(lines, "sudo rm -f /etc/profile.d/hobo-proxy.sh")
+		}
+	}
+
+	if hi.User {
+		u, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("HostIdentity.User: %v", err)
+		}
+		userLines, err := guestUserCmdLines(u, gitCmds, hi.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, userLines...)
+	}
+	return lines, nil
+}
+
+// Return the command lines that create a guest user matching the host
+// user u. An existing user is only accepted if its uid matches. The gid
+// keeps its number, even if the guest already has a group by that number.
+// With proxy, the user joins the hobo user's group to read the proxy file.
+func guestUserCmdLines(u *user.User, gitCmds []string, proxy bool) ([]string, error) {
+	if u.Uid == "0" || u.Username == "root" {
+		return nil, fmt.Errorf("HostIdentity.User: refusing to copy the root user")
+	}
+	if u.Username == "hobo" {
+		return nil, nil
+	}
+	lines := []string{
+		"u=" + shellQuote(u.Username) + " uid=" + u.Uid + " gid=" + u.Gid,
+		`getent group "$gid" >/dev/null || sudo groupadd -g "$gid" "$u"`,
+		`id -u "$u" >/dev/null 2>&1 || sudo useradd -m -s /bin/bash -u "$uid" -g "$gid" "$u"`,
+		`if [ "$(id -u "$u")" != "$uid" ]; then echo "guest user $u exists with a uid other than $uid" >&2; exit 1; fi`,
+		`h=$(getent passwd "$u" | cut -d: -f6)`,
+		`sudo install -d -m 700 -o "$uid" -g "$gid" "$h/.ssh"`,
+		`sudo install -m 600 -o "$uid" -g "$gid" ~/.ssh/authorized_keys "$h/.ssh/authorized_keys"`,
+		`echo "$u ALL=(ALL) NOPASSWD:ALL" | sudo tee "/etc/sudoers.d/hobo-$u" >/dev/null`,
+		`sudo chmod 440 "/etc/sudoers.d/hobo-$u"`,
+	}
+	if proxy {
+		lines = append(lines, `sudo usermod -a -G "$(id -gn)" "$u"`)
+	}
+	for _, c := range gitCmds {
+		lines = append(lines, `if command -v git >/dev/null; then sudo -H -u "$u" `+c+"; fi")
+	}
+	return lines, nil
+}
+
+// Return a stand-in for the host identity step, or nil if HostIdentity is
+// off. It has the step's name but reads nothing from the host, so the steps
+// can be checked when the config is loaded without running git, reading
+// keys or registering redactions.
+func (m *Machine) hostIdentityPlaceholder() *Provisioner {
+	if !m.HostIdentity.enabled() {
+		return nil
+	}
+	return &Provisioner{Name: hostIdentityStepName, Inline: []string{"true"}}
+}
+
+// Return the step that copies the host identity, or nil if there is
+// nothing to copy.
+func (m *Machine) hostIdentityStep(ctx context.Context) (*Provisioner, error) {
+	if !m.HostIdentity.enabled() {
+		return nil, nil
+	}
+	lines, err := m.HostIdentity.cmdLines(ctx)
+	if err != nil || len(lines) == 0 {
+		return nil, err
+	}
+	return &Provisioner{Name: hostIdentityStepName, Inline: lines}, nil
+}
@@ -0,0 +1,212 @@
+package hobo
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	idleCheckInterval = time.Minute
+	// A guest with a 1 minute load average above this is busy, even with
+	// nobody logged in.
+	idleLoadThreshold = 0.3
+)
+
+// Report guest activity as three lines: the 1 minute load average, the
+// number of login sessions and the number of established connections to
+// the given ports. The probe itself does not allocate a tty, so it doesn't
+// count as a login. It is single quoted on the remote command line, so it
+// must not contain single quotes.
+const guestActivityScript = `read load1 rest < /proc/loadavg
+echo $load1
+who | wc -l
+ports="$*"
+n=0
+for p in $ports; do
+  c=$(ss -tnH state established "( sport = :$p )" 2>/dev/null | wc -l)
+  n=$((n + c))
+done
+echo $n`
+
+type guestActivity struct {
+	Load1       float64
+	Sessions    int
+	Connections int
+}
+
+func (ga guestActivity) active() bool {
+	return ga.Sessions > 0 || ga.Connections > 0 || ga.Load1 > idleLoadThreshold
+}
+
+// Probe the guest for signs that somebody is using it.
+func (vm *Instance) guestActivity(ctx context.Context) (guestActivity, error) {
+	ga := guestActivity{}
+	ipAddr, err := vm.getIpAddr(ctx)
+	if err != nil {
+		return ga, err
+	}
+	fwds, err := vm.readForwards()
+	if err != nil {
+		return ga, err
+	}
+	remoteCmd := []string{"sh", "-c", "'" + guestActivityScript + "'", "-"}
+	for _, fw := range fwds {
+		remoteCmd = append(remoteCmd, strconv.Itoa(fw.GuestPort))
+	}
+	cmd := vm.sshCommand(ctx, ipAddr, vm.vmConfig.sshId, remoteCmd...)
+	out, err := cmd.Output()
+	if err != nil {
+		vm.checkSshFailure(err)
+		logCmdError(vm.Logger(), cmd, err)
+		return ga, err
+	}
+	lines := strings.Fields(string(out))
+	if len(lines) != 3 {
+		return ga, fmt.Errorf("unexpected activity probe output: %q", out)
+	}
+	if ga.Load1, err = strconv.ParseFloat(lines[0], 64); err != nil {
+		return ga, err
+	}
+	if ga.Sessions, err = strconv.Atoi(lines[1]); err != nil {
+		return ga, err
+	}
+	if ga.Connections, err = strconv.Atoi(lines[2]); err != nil {
+		return ga, err
+	}
+	return ga, nil
+}
+
+// An idleWatcher suspends running instances that have been idle for longer
+// than their IdleSuspendAfter.
+type idleWatcher struct {
+	ac AppConfig
+	// lock serialises the suspend with other operations on the instance.
+	lock       func(name string) (unlock func())
+	lastActive map[string]time.Time
+	// probeFailures counts the probes that failed in a row for each
+	// instance. A guest that can't be probed is not counted as active, so
+	// one that is unreachable is still suspended.
+	probeFailures map[string]int
+}
+
+func newIdleWatcher(ac AppConfig, lock func(name string) func()) *idleWatcher {
+	if lock == nil {
+		lock = func(string) func() { return func() {} }
+	}
+	return &idleWatcher{ac: ac, lock: lock, lastActive: make(map[string]time.Time),
+		probeFailures: make(map[string]int)}
+}
+
+func (w *idleWatcher) check(ctx context.Context) error {
+	running, err := getRunningVmxSet(ctx, &w.ac)
+	if err != nil {
+		return err
+	}
+	fis, err := ioutil.ReadDir(w.ac.vmsDir())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	now := time.Now()
+	for _, fi := range fis {
+		if path.Ext(fi.Name()) != ".vmwarevm" {
+			continue
+		}
+		name := strings.TrimSuffix(fi.Name(), ".vmwarevm")
+		vm, err := readInstanceForName(w.ac, name)
+		if err != nil || !running[vm.vmConfig.vmxFile] {
+			delete(w.lastActive, name)
+			delete(w.probeFailures, name)
+			continue
+		}
+		idleAfter := time.Duration(vm.vmConfig.IdleSuspendAfter)
+		if idleAfter <= 0 {
+			continue
+		}
+		// Give a vm we haven't seen before the full idle period.
+		if _, ok := w.lastActive[name]; !ok {
+			w.lastActive[name] = now
+		}
+
+		ga, err := vm.guestActivity(ctx)
+		if err != nil {
+			w.probeFailures[name]++
+			vm.Logger().Warnf("unable to check activity, %d failures in a row: %v", w.probeFailures[name], err)
+		} else {
+			w.probeFailures[name] = 0
+			if ga.active() {
+				vm.Logger().Debugf("active: load %.2f sessions %d connections %d", ga.Load1, ga.Sessions, ga.Connections)
+				w.lastActive[name] = now
+				continue
+			}
+		}
+		if now.Sub(w.lastActive[name]) < idleAfter {
+			continue
+		}
+		if err := w.suspend(ctx, name); err != nil {
+			vm.Logger().Warnf("unable to suspend idle vm: %v", err)
+			continue
+		}
+		delete(w.lastActive, name)
+		delete(w.probeFailures, name)
+	}
+	return nil
+}
+
+// Suspend an idle instance. It is read again under the lock, since another
+// command may have started, stopped or reconfigured it since it was probed.
+func (w *idleWatcher) suspend(ctx context.Context, name string) error {
+	unlock := w.lock(name)
+	defer unlock()
+	vm, err := readInstanceForName(w.ac, name)
+	if err != nil {
+		return err
+	}
+	if vm.vmConfig.IdleSuspendAfter <= 0 {
+		return nil
+	}
+	if running, err := vm.isRunning(ctx); err != nil || !running {
+		return err
+	}
+	// A vm that was just started or resumed gets a fresh idle period.
+	if vm.vmConfig.TimeStateChanged.After(w.lastActive[name]) {
+		w.lastActive[name] = vm.vmConfig.TimeStateChanged
+		return nil
+	}
+	idle := time.Since(w.lastActive[name]).Truncate(time.Second)
+	if n := w.probeFailures[name]; n > 0 {
+		vm.Logger().Infof("Suspending after %s idle, the last %d activity probes failed", idle, n)
+	} else {
+		vm.Logger().Infof("Suspending after %s idle", idle)
+	}
+	return suspendInstance(ctx, vm)
+}
+
+func (w *idleWatcher) watch(ctx context.Context) {
+	for {
+		if err := w.check(ctx); err != nil {
+			StdLogger.Warnf("idle check failed: %v", err)
+		}
+		select {
+		case <-time.After(idleCheckInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Suspend instances that have been idle for longer than their
+// IdleSuspendAfter, until ctx is done. A running daemon already does this.
+func (ac *AppConfig) WatchIdle(ctx context.Context) error {
+	if dc := ac.DaemonClient(); dc != nil {
+		return fmt.Errorf("hobo daemon is running and already suspends idle vms")
+	}
+	StdLogger.Infof("Watching for idle vms in %s", ac.vmsDir())
+	newIdleWatcher(*ac, nil).watch(ctx)
+	return nil
+}
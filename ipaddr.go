@@ -0,0 +1,395 @@
+package hobo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An ipResolver is one way of discovering the address of a vm. Resolvers
+// that have to wait for the guest poll until their context is done.
+type ipResolver interface {
+	name() string
+	resolve(ctx context.Context, vm *Instance) (string, error)
+}
+
+// An ipStrategy bounds a resolver with its own deadline.
+type ipStrategy struct {
+	resolver ipResolver
+	timeout  time.Duration
+}
+
+// The result of ip resolution and which resolver produced it.
+type IpResult struct {
+	IpAddr string
+	Source string
+}
+
+// Use the cached address if there is one, otherwise race the live resolvers.
+// The lease file and arp table are cheap and usually answer within a few
+// seconds of boot, vmtools is slow but the most authoritative.
+var defaultIpStrategies = [][]ipStrategy{
+	{{cachedIpResolver{}, 0}},
+	{
+		{dhcpLeaseIpResolver{}, 60 * time.Second},
+		{arpIpResolver{}, 60 * time.Second},
+		{vmtoolsIpResolver{}, 5 * time.Minute},
+	},
+}
+
+// The strategies to use when the cached address cannot be trusted.
+var liveIpStrategies = defaultIpStrategies[1:]
+
+// How long the cached address is used without checking it again, so a run
+// of commands doesn't dial the guest and scan its host keys every time. A
+// failed ssh or a change of power state ends it early.
+const ipAddrTrustedFor = time.Minute
+
+// Return true if the cached address was checked recently enough to use as
+// is.
+func (vc *vmConfig) ipAddrTrusted(now time.Time) bool {
+	return vc.IpAddr != "" && vc.TimeIpAddrValidated.After(vc.TimeStateChanged) &&
+		!now.Before(vc.TimeIpAddrValidated) && now.Sub(vc.TimeIpAddrValidated) < ipAddrTrustedFor
+}
+
+// Resolve the vm address and remember it if it changed. The cached address
+// is refreshed for bootstrapped instances only, a clone in progress saves its
+// address when bootstrap completes.
+func (vm *Instance) RefreshIpAddr(ctx context.Context) (IpResult, error) {
+	if vm.vmConfig.ipAddrTrusted(time.Now()) {
+		return IpResult{IpAddr: vm.vmConfig.IpAddr, Source: (cachedIpResolver{}).name()}, nil
+	}
+	res, err := vm.resolveIpAddr(ctx, defaultIpStrategies)
+	if err != nil {
+		return res, err
+	}
+	if vm.vmConfig.TimeBootstrapped.IsZero() {
+		return res, nil
+	}
+	changed := res.IpAddr != vm.vmConfig.IpAddr
+	if changed {
+		vm.Logger().Infof("Updating ip addr from %s to %s", vm.vmConfig.IpAddr, res.IpAddr)
+	}
+	err = vm.updateConfig(func(c *vmConfig) error {
+		now := time.Now()
+		if changed {
+			c.IpAddr = res.IpAddr
+			c.TimeIpAddrUpdated = now
+		}
+		c.TimeIpAddrValidated = now
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	if !changed {
+		return res, nil
+	}
+	if err := vm.vmConfig.appConfig.updateSshConfigFile(); err != nil {
+		vm.Logger().Warnf("unable to update ssh config: %s", err)
+	}
+	return res, nil
+}
+
+// Stop trusting the cached address if err shows that ssh itself failed, so
+// the next lookup checks the address again.
+func (vm *Instance) checkSshFailure(err error) {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != sshExitStatus {
+		return
+	}
+	if vm.vmConfig.TimeIpAddrValidated.IsZero() {
+		return
+	}
+	err = vm.updateConfig(func(c *vmConfig) error {
+		c.TimeIpAddrValidated = time.Time{}
+		return nil
+	})
+	if err != nil {
+		vm.Logger().Warnf("unable to update config: %v", err)
+	}
+}
+
+// Resolve the vm address by trying each stage of strategies in order. The
+// strategies within a stage are raced and the first answer wins.
+func (vm *Instance) resolveIpAddr(ctx context.Context, stages [][]ipStrategy) (IpResult, error) {
+	errs := make([]string, 0, 4)
+	for _, stage := range stages {
+		res, err := vm.raceIpStrategies(ctx, stage)
+		if err == nil {
+			if res.Source != (cachedIpResolver{}).name() {
+				vm.Logger().Infof("Found ip addr %s from %s", res.IpAddr, res.Source)
+			}
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			return IpResult{}, ctx.Err()
+		}
+		errs = append(errs, err.Error())
+	}
+	return IpResult{}, fmt.Errorf("%w for %s: %s", ErrNoIpAddr, vm.name, strings.Join(errs, "; "))
+}
+
+func (vm *Instance) raceIpStrategies(ctx context.Context, strategies []ipStrategy) (IpResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type answer struct {
+		res IpResult
+		err error
+	}
+	answerC := make(chan answer, len(strategies))
+	for _, strategy := range strategies {
+		go func(strategy ipStrategy) {
+			sctx := ctx
+			if strategy.timeout > 0 {
+				var scancel context.CancelFunc
+				sctx, scancel = context.WithTimeout(ctx, strategy.timeout)
+				defer scancel()
+			}
+			name := strategy.resolver.name()
+			ipAddr, err := strategy.resolver.resolve(sctx, vm)
+			if err != nil {
+				err = fmt.Errorf("%s: %v", name, err)
+			}
+			answerC <- answer{IpResult{IpAddr: ipAddr, Source: name}, err}
+		}(strategy)
+	}
+
+	errs := make([]string, 0, len(strategies))
+	for range strategies {
+		ans := <-answerC
+		if ans.err == nil {
+			return ans.res, nil
+		}
+		errs = append(errs, ans.err.Error())
+	}
+	return IpResult{}, errors.New(strings.Join(errs, ", "))
+}
+
+// The address saved in the instance config. Dhcp leases change, so the
+// address is only returned if it still leads to this guest.
+type cachedIpResolver struct{}
+
+func (cachedIpResolver) name() string { return "cache" }
+
+func (cachedIpResolver) resolve(ctx context.Context, vm *Instance) (string, error) {
+	if vm.vmConfig.IpAddr == "" {
+		return "", ErrNoIpAddr
+	}
+	if err := vm.validateIpAddr(ctx, vm.vmConfig.IpAddr); err != nil {
+		vm.Logger().Infof("Cached ip addr %s is stale: %v", vm.vmConfig.IpAddr, err)
+		return "", err
+	}
+	return vm.vmConfig.IpAddr, nil
+}
+
+var errStaleIpAddr = errors.New("ip address belongs to another host")
+
+// Check that ipAddr is reachable and is really this guest, not whatever was
+// handed the address after our lease expired. A pinned host key is the best
+// evidence, failing that the arp table must not map the address to a
+// different mac.
+func (vm *Instance) validateIpAddr(ctx context.Context, ipAddr string) error {
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ipAddr, "22"))
+	if err != nil {
+		return err
+	}
+	conn.Close()
+
+	if vm.hasKnownHosts() {
+		if match, err := vm.matchHostKeys(ctx, ipAddr); err == nil {
+			if !match {
+				return errStaleIpAddr
+			}
+			return nil
+		}
+	}
+
+	macAddr, err := vm.getMacAddr()
+	if err != nil {
+		return err
+	}
+	arpMacAddr, err := findMacAddrFromArp(ctx, ipAddr)
+	if err != nil {
+		// No evidence either way, trust the address since it answered.
+		return nil
+	}
+	if normalizeMacAddr(arpMacAddr) != normalizeMacAddr(macAddr) {
+		return errStaleIpAddr
+	}
+	return nil
+}
+
+// Return true if the host at ipAddr presents one of the pinned host keys.
+func (vm *Instance) matchHostKeys(ctx context.Context, ipAddr string) (bool, error) {
+	pinned, err := ioutil.ReadFile(vm.vmConfig.knownHostsFile)
+	if err != nil {
+		return false, err
+	}
+	pinnedKeys := make(map[string]bool)
+	for _, line := range strings.Split(string(pinned), "\n") {
+		// hobo-name ssh-ed25519 AAAAC3Nza...
+		fields := strings.Fields(line)
+		if len(fields) >= 3 {
+			pinnedKeys[fields[1]+" "+fields[2]] = true
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, "ssh-keyscan", "-T", "2", ipAddr)
+	data, err := cmd.Output()
+	if err != nil {
+		return false, err
+	}
+	found := false
+	for _, line := range strings.Split(string(data), "\n") {
+		// 192.168.254.169 ssh-ed25519 AAAAC3Nza...
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		found = true
+		if pinnedKeys[fields[1]+" "+fields[2]] {
+			return true, nil
+		}
+	}
+	if !found {
+		return false, fmt.Errorf("no host keys from %s", ipAddr)
+	}
+	return false, nil
+}
+
+// The vmware dhcp server lease file, matched by the mac address in the vmx.
+type dhcpLeaseIpResolver struct{}
+
+func (dhcpLeaseIpResolver) name() string { return "dhcp-lease" }
+
+// The last lease for the mac address may be left over from an earlier boot,
+// so it only wins once it answers as the guest. Until then the lease is
+// read again, since a new one may turn up.
+func (dhcpLeaseIpResolver) resolve(ctx context.Context, vm *Instance) (string, error) {
+	for {
+		ipAddr, err := vm.getIpAddrFromVmdhcp(ctx)
+		if err != nil {
+			return "", err
+		}
+		err = vm.validateIpAddr(ctx, ipAddr)
+		if err == nil {
+			return ipAddr, nil
+		}
+		vm.Logger().Debugf("dhcp lease %s not usable yet: %v", ipAddr, err)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// The vmrun getGuestIPAddress command, which needs VMware Tools in the guest.
+type vmtoolsIpResolver struct{}
+
+func (vmtoolsIpResolver) name() string { return "vmtools" }
+
+func (vmtoolsIpResolver) resolve(ctx context.Context, vm *Instance) (string, error) {
+	return vm.getIpAddrFromVmtools(ctx)
+}
+
+// The host arp or neighbor table, matched by the mac address in the vmx.
+// This only works once the host has exchanged packets with the guest, but
+// it doesn't depend on the vmware dhcp server.
+type arpIpResolver struct{}
+
+func (arpIpResolver) name() string { return "arp" }
+
+func (arpIpResolver) resolve(ctx context.Context, vm *Instance) (string, error) {
+	macAddr, err := vm.getMacAddr()
+	if err != nil {
+		return "", err
+	}
+	for {
+		ipAddr, err := findIpAddrFromArp(ctx, macAddr)
+		if err != ErrNoIpAddr {
+			return ipAddr, err
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// ? (192.168.254.169) at 0:c:29:ff:94:8f on vmnet8 ifscope [ethernet]
+var arpLineRe = regexp.MustCompile(`\(([0-9.]+)\) at ([0-9a-fA-F:]+)`)
+
+// Return the arp table as (ip addr, mac addr) pairs.
+func readArpTable(ctx context.Context) ([][2]string, error) {
+	cmd := exec.CommandContext(ctx, "arp", "-an")
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseArpTable(data), nil
+}
+
+// Parse the output of arp -an into (ip addr, mac addr) pairs, skipping
+// incomplete entries.
+func parseArpTable(data []byte) [][2]string {
+	entries := make([][2]string, 0, 16)
+	for _, line := range strings.Split(string(bytes.TrimSpace(data)), "\n") {
+		match := arpLineRe.FindStringSubmatch(line)
+		if match != nil {
+			entries = append(entries, [2]string{match[1], match[2]})
+		}
+	}
+	return entries
+}
+
+func findIpAddrFromArp(ctx context.Context, macAddr string) (string, error) {
+	entries, err := readArpTable(ctx)
+	if err != nil {
+		return "", err
+	}
+	want := normalizeMacAddr(macAddr)
+	for _, entry := range entries {
+		if normalizeMacAddr(entry[1]) == want {
+			return entry[0], nil
+		}
+	}
+	return "", ErrNoIpAddr
+}
+
+func findMacAddrFromArp(ctx context.Context, ipAddr string) (string, error) {
+	entries, err := readArpTable(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if entry[0] == ipAddr {
+			return entry[1], nil
+		}
+	}
+	return "", fmt.Errorf("no arp entry for %s", ipAddr)
+}
+
+// The BSD arp command drops leading zeros from each octet, so compare mac
+// addresses by value.
+func normalizeMacAddr(macAddr string) string {
+	octets := strings.Split(macAddr, ":")
+	for i, octet := range octets {
+		if n, err := strconv.ParseUint(octet, 16, 8); err == nil {
+			octets[i] = fmt.Sprintf("%02x", n)
+		}
+	}
+	return strings.Join(octets, ":")
+}
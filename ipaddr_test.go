@@ -0,0 +1,87 @@
+package hobo
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNormalizeMacAddr(t *testing.T) {
+	tests := []struct {
+		macAddr string
+		want    string
+	}{
+		{"00:0c:29:ff:94:8f", "00:0c:29:ff:94:8f"},
+		{"0:c:29:ff:94:8f", "00:0c:29:ff:94:8f"},
+		{"00:0C:29:FF:94:8F", "00:0c:29:ff:94:8f"},
+		{"0:0:0:0:0:0", "00:00:00:00:00:00"},
+		// Octets that don't parse are left alone.
+		{"zz:c:29", "zz:0c:29"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeMacAddr(tt.macAddr); got != tt.want {
+			t.Errorf("normalizeMacAddr(%q) = %q, want %q", tt.macAddr, got, tt.want)
+		}
+	}
+}
+
+func TestParseArpTable(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want [][2]string
+	}{
+		{"empty", "", [][2]string{}},
+		{
+			"bsd",
+			"? (192.168.254.169) at 0:c:29:ff:94:8f on vmnet8 ifscope [ethernet]\n" +
+				"? (192.168.254.255) at ff:ff:ff:ff:ff:ff on vmnet8 ifscope [ethernet]\n",
+			[][2]string{
+				{"192.168.254.169", "0:c:29:ff:94:8f"},
+				{"192.168.254.255", "ff:ff:ff:ff:ff:ff"},
+			},
+		},
+		{
+			"linux",
+			"? (172.16.5.130) at 00:0c:29:ab:cd:ef [ether] on vmnet8\n",
+			[][2]string{{"172.16.5.130", "00:0c:29:ab:cd:ef"}},
+		},
+		{
+			"incomplete",
+			"? (192.168.254.2) at (incomplete) on vmnet8 ifscope [ethernet]\n" +
+				"? (192.168.254.3) at 0:50:56:e3:5:1 on vmnet8 ifscope [ethernet]\n",
+			[][2]string{{"192.168.254.3", "0:50:56:e3:5:1"}},
+		},
+	}
+	for _, tt := range tests {
+		if got := parseArpTable([]byte(tt.data)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseArpTable() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIpAddrTrusted(t *testing.T) {
+	now := time.Date(2020, 1, 5, 12, 0, 0, 0, time.UTC)
+	started := now.Add(-time.Hour)
+	tests := []struct {
+		name      string
+		ipAddr    string
+		validated time.Time
+		trusted   bool
+	}{
+		{"recent", "10.0.0.2", now.Add(-10 * time.Second), true},
+		{"expired", "10.0.0.2", now.Add(-ipAddrTrustedFor), false},
+		{"never validated", "10.0.0.2", time.Time{}, false},
+		{"no address", "", now.Add(-10 * time.Second), false},
+		// The vm changed state since, so it may have a new lease.
+		{"before state change", "10.0.0.2", started.Add(-time.Second), false},
+		{"clock went back", "10.0.0.2", now.Add(time.Minute), false},
+	}
+	for _, tt := range tests {
+		vc := &vmConfig{IpAddr: tt.ipAddr, TimeIpAddrValidated: tt.validated, TimeStateChanged: started}
+		if got := vc.ipAddrTrusted(now); got != tt.trusted {
+			t.Errorf("%s: ipAddrTrusted() = %v, want %v", tt.name, got, tt.trusted)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package hobo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Host keys are pinned under an alias rather than the ip address so the
+// known_hosts entries survive dhcp handing out a new address.
+func (vm *Instance) hostKeyAlias() string {
+	return "hobo-" + vm.name
+}
+
+// Return true if the guest host keys have been captured for this instance.
+// Instances bootstrapped before host key pinning fall back to unchecked ssh.
+func (vm *Instance) hasKnownHosts() bool {
+	_, err := os.Stat(vm.vmConfig.knownHostsFile)
+	return err == nil
+}
+
+// Write out the shared bootstrap key so ssh can use it. This key is public
+// knowledge and only good for the first login to a fresh boxcar.
+func (ac *AppConfig) writeBootstrapInsecureKey() (string, error) {
+	sshId := path.Join(ac.HoboDir, "hobo-bootstrap-insecure")
+	if _, err := os.Stat(sshId); err == nil {
+		return sshId, nil
+	}
+	if err := writeFileAtomic(sshId, []byte(bootstrapInsecurePrivateKey), 0600); err != nil {
+		return "", err
+	}
+	return sshId, nil
+}
+
+// Place the instance public key in the vmx so a boxcar with a first boot
+// seed can install it without ever trusting the insecure key. The guest
+// reads it with:
+//
+//	vmware-rpctool "info-get guestinfo.hobo.authorizedKeys"
+//
+// This must happen before the first start of the clone.
+func (vm *Instance) seedGuestinfoKey() error {
+	pubKey, err := ioutil.ReadFile(vm.vmConfig.sshIdPub)
+	if err != nil {
+		return err
+	}
+	fout, err := os.OpenFile(vm.vmConfig.vmxFile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	line := fmt.Sprintf("guestinfo.hobo.authorizedKeys = %q\n", strings.TrimSpace(string(pubKey)))
+	if _, err := fout.WriteString(line); err != nil {
+		return err
+	}
+	return fout.Close()
+}
+
+// Return true if the guest accepts a login with the given key. A refused
+// key is not an error, but failing to connect at all is.
+func (vm *Instance) acceptsKey(ctx context.Context, ipAddr, sshId string) (bool, error) {
+	cmd := vm.sshCommand(ctx, ipAddr, sshId, "/bin/true")
+	cmd.Args = append(cmd.Args[:1], append([]string{"-oBatchMode=yes"}, cmd.Args[1:]...)...)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return true, nil
+	}
+	if bytes.Contains(out, []byte("Permission denied")) {
+		return false, nil
+	}
+	return false, fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+}
+
+// Generate a new ed25519 client key pair at the given path.
+func generateSshKey(ctx context.Context, l *Logger, sshId, comment string) error {
+	return runCmd(ctx, l, "/usr/bin/ssh-keygen",
+		"-t", "ed25519",
+		"-C", comment,
+		"-N", "",
+		"-f", sshId,
+	)
+}
+
+// Build an ssh command to run remoteCmd in the guest authenticating with
+// sshId. The caller is responsible for wiring up stdio.
+func (vm *Instance) sshCommand(ctx context.Context, ipAddr, sshId string, remoteCmd ...string) *exec.Cmd {
+	args := vm.sshCmdArgs()
+	args = append(args, "-i", sshId, "hobo@"+ipAddr)
+	args = append(args, remoteCmd...)
+	vm.Logger().Debugf("run ssh %v", remoteCmd)
+	return exec.CommandContext(ctx, "/usr/bin/ssh", args[1:]...)
+}
+
+// Read the guest's public host keys and pin them in the instance's
+// known_hosts file. This trusts the first connection, which is made before
+// any keys are known.
+func (vm *Instance) captureHostKeys(ctx context.Context, ipAddr, sshId string) error {
+	cmd := vm.sshCommand(ctx, ipAddr, sshId, "cat /etc/ssh/ssh_host_*_key.pub")
+	out, err := cmd.Output()
+	if err != nil {
+		logCmdError(vm.Logger(), cmd, err)
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// ssh-ed25519 AAAAC3Nza... root@host
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		fmt.Fprintf(buf, "%s %s %s\n", vm.hostKeyAlias(), fields[0], fields[1])
+	}
+	if buf.Len() == 0 {
+		return fmt.Errorf("no host keys found on %s", ipAddr)
+	}
+	return writeFileAtomic(vm.vmConfig.knownHostsFile, buf.Bytes(), 0644)
+}
+
+// Replace the instance client key. The new key is added alongside the old
+// one and verified before the old one is revoked, so a failure part way
+// through never locks us out. Only the old key's line is removed from
+// authorized_keys, any other keys stay.
+func (vm *Instance) rekey(ctx context.Context, ipAddr string) error {
+	oldPubKey, err := ioutil.ReadFile(vm.vmConfig.sshIdPub)
+	if err != nil {
+		return err
+	}
+	oldFields := strings.Fields(string(oldPubKey))
+	if len(oldFields) < 2 {
+		return fmt.Errorf("malformed public key %s", vm.vmConfig.sshIdPub)
+	}
+
+	newId := vm.vmConfig.sshId + ".new"
+	newIdPub := newId + ".pub"
+	for _, fname := range []string{newId, newIdPub} {
+		if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := generateSshKey(ctx, vm.Logger(), newId, "hobo-"+vm.name); err != nil {
+		return err
+	}
+	pubKey, err := ioutil.ReadFile(newIdPub)
+	if err != nil {
+		return err
+	}
+
+	cmd := vm.sshCommand(ctx, ipAddr, vm.vmConfig.sshId, "cat >> .ssh/authorized_keys")
+	cmd.Stdin = bytes.NewReader(pubKey)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("adding new key: %v: %s", err, out)
+	}
+
+	// grep fails if it selects no lines, but the new key is always left.
+	cmd = vm.sshCommand(ctx, ipAddr, newId,
+		"k=.ssh/authorized_keys; grep -vF "+shellQuote(oldFields[1])+" $k > $k.hobo-new; "+
+			"chmod 600 $k.hobo-new && mv $k.hobo-new $k")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("revoking old key: %v: %s", err, out)
+	}
+
+	if err := os.Rename(newIdPub, vm.vmConfig.sshIdPub); err != nil {
+		return err
+	}
+	return os.Rename(newId, vm.vmConfig.sshId)
+}
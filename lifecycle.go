@@ -0,0 +1,227 @@
+package hobo
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Transitional states are recorded in the instance config while an operation
+// is under way, so an interrupted operation is visible afterwards.
+const (
+	stateStarting   = "starting"
+	stateStopping   = "stopping"
+	stateSuspending = "suspending"
+	stateResuming   = "resuming"
+	stateRestarting = "restarting"
+)
+
+func isTransitional(state string) bool {
+	switch state {
+	case stateStarting, stateStopping, stateSuspending, stateResuming, stateRestarting:
+		return true
+	}
+	return false
+}
+
+// The transitions an operation may make from each state. The vm can also be
+// changed outside of hobo, so syncState moves to the observed power state
+// without checking this.
+var stateTransitions = map[string][]string{
+	StateStopped:    {stateStarting},
+	stateStarting:   {StateRunning, StateStopped},
+	StateRunning:    {stateStopping, stateSuspending, stateRestarting},
+	stateStopping:   {StateStopped, StateRunning},
+	stateSuspending: {StateSuspended, StateRunning},
+	StateSuspended:  {stateResuming, stateStopping},
+	stateResuming:   {StateRunning, StateSuspended},
+	stateRestarting: {StateRunning, StateStopped},
+}
+
+// Move to a new state and save it.
+func (vm *Instance) setState(to string) error {
+	return vm.updateConfig(func(c *vmConfig) error {
+		from := c.State
+		if from == to {
+			return nil
+		}
+		ok := from == ""
+		for _, s := range stateTransitions[from] {
+			ok = ok || s == to
+		}
+		if !ok {
+			return fmt.Errorf("%w: can't go from %s to %s", ErrInvalidState, from, to)
+		}
+		vm.Logger().Debugf("state %s -> %s", from, to)
+		c.State = to
+		c.TimeStateChanged = time.Now()
+		return nil
+	})
+}
+
+// Save the power state vmrun reports and return it.
+func (vm *Instance) syncState(ctx context.Context) (string, error) {
+	running, err := vm.isRunning(ctx)
+	if err != nil {
+		return "", err
+	}
+	state := StateStopped
+	if running {
+		state = StateRunning
+	} else if vm.isSuspended() {
+		state = StateSuspended
+	}
+	err = vm.updateConfig(func(c *vmConfig) error {
+		if c.State == state {
+			return nil
+		}
+		if c.State != "" {
+			vm.Logger().Debugf("state %s -> %s (observed)", c.State, state)
+		}
+		c.State = state
+		c.TimeStateChanged = time.Now()
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return state, nil
+}
+
+// Run fn in the transitional state during and then record the state the vm
+// ended up in, whether fn succeeded or not.
+func (vm *Instance) transition(ctx context.Context, during string, fn func() error) error {
+	if _, err := vm.syncState(ctx); err != nil {
+		return err
+	}
+	if err := vm.setState(during); err != nil {
+		return err
+	}
+	err := fn()
+	// ctx may be why fn failed, so don't depend on it to record the outcome.
+	syncCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, syncErr := vm.syncState(syncCtx); syncErr != nil && err == nil {
+		err = syncErr
+	}
+	return err
+}
+
+// Stop the vm, then stop forwarding ports. The forwards are kept if the vm
+// fails to stop. Stopping a stopped vm succeeds.
+func stopInstance(ctx context.Context, vm *Instance, hard bool) error {
+	state, err := vm.syncState(ctx)
+	if err != nil {
+		return err
+	}
+	if state != StateStopped {
+		err := vm.transition(ctx, stateStopping, func() error {
+			return vm.stop(ctx, hard)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return vm.teardownForwarding()
+}
+
+// Suspend the vm, then stop forwarding ports. The forwards are kept if the
+// vm fails to suspend. Suspending a suspended vm succeeds.
+func suspendInstance(ctx context.Context, vm *Instance) error {
+	state, err := vm.syncState(ctx)
+	if err != nil {
+		return err
+	}
+	if state != StateSuspended {
+		err := vm.transition(ctx, stateSuspending, func() error {
+			return vm.suspend(ctx)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return vm.teardownForwarding()
+}
+
+// Reboot the guest and wait for ssh to come back.
+func restartInstance(ctx context.Context, vm *Instance) error {
+	state, err := vm.syncState(ctx)
+	if err != nil {
+		return err
+	}
+	if state != StateRunning {
+		return fmt.Errorf("%w: vm is %s, not running", ErrInvalidState, state)
+	}
+	return vm.transition(ctx, stateRestarting, func() error {
+		return vm.reboot(ctx)
+	})
+}
+
+// Reboot through VMware Tools, or with sudo reboot over ssh if Tools don't
+// respond. The reboot is complete once the guest reports a new boot id.
+func (vm *Instance) reboot(ctx context.Context) error {
+	ipAddr, err := vm.getIpAddr(ctx)
+	if err != nil {
+		return err
+	}
+	bootId, err := vm.guestBootId(ctx, ipAddr)
+	if err != nil {
+		return err
+	}
+
+	vm.Logger().Infof("Restarting %s", vm.vmConfig.vmxFile)
+	err = retryVmrun(ctx, vm.Logger(), func() error {
+		return runVmrun(ctx, vm.Logger(), vm.vmConfig.appConfig.VmrunBinaryPath,
+			"reset", vm.vmConfig.vmxFile, "soft")
+	})
+	if err != nil {
+		vm.Logger().Warnf("soft reset failed: %v", err)
+		vm.Logger().Infof("Rebooting from the guest")
+		cmd := vm.sshCommand(ctx, ipAddr, vm.vmConfig.sshId, "sudo", "reboot")
+		// The connection drops as the guest goes down.
+		if out, err := cmd.CombinedOutput(); err != nil {
+			vm.Logger().Debugf("cmd failed: %v: %v\n%s", cmd.Args, err, out)
+		}
+	}
+
+	bootCtx, cancel := withTimeout(ctx, vm.vmConfig.appConfig.Timeouts.Boot)
+	defer cancel()
+	vm.Logger().Infof("Waiting for ssh on %s", ipAddr)
+	for {
+		if id, err := vm.guestBootId(bootCtx, ipAddr); err == nil && id != bootId {
+			break
+		}
+		select {
+		case <-time.After(2 * time.Second):
+		case <-bootCtx.Done():
+			return fmt.Errorf("%w: guest did not come back after reboot", ErrSshTimeout)
+		}
+	}
+	return vm.updateConfig(func(c *vmConfig) error {
+		c.TimeStarted = time.Now()
+		return nil
+	})
+}
+
+// Return the id the guest kernel picks at random on each boot.
+func (vm *Instance) guestBootId(ctx context.Context, ipAddr string) (string, error) {
+	cmd := vm.sshCommand(ctx, ipAddr, vm.vmConfig.sshId, "cat", "/proc/sys/kernel/random/boot_id")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// Set the guest clock from the host. The guest clock stands still while the
+// vm is suspended, and is slow to catch up on its own.
+func (vm *Instance) syncGuestClock(ctx context.Context, ipAddr string) {
+	vm.Logger().Infof("Syncing guest clock")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	cmd := vm.sshCommand(ctx, ipAddr, vm.vmConfig.sshId, "sudo", "date", "-u", "-s", "@"+now)
+	if err := cmd.Run(); err != nil {
+		logCmdError(vm.Logger(), cmd, err)
+		vm.Logger().Warnf("unable to sync guest clock: %v", err)
+	}
+}
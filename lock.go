@@ -0,0 +1,29 @@
+package hobo
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Take an exclusive flock on fname, creating it if need be. With wait
+// unset, a lock held elsewhere is an error rather than a wait. The lock is
+// released by calling unlock, or when the process exits.
+func lockFile(fname string, wait bool) (unlock func(), err error) {
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%s is locked by another process", fname)
+		}
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
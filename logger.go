@@ -0,0 +1,321 @@
+package hobo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The level of a log message.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (lv LogLevel) String() string {
+	return [...]string{"debug", "info", "warning", "error"}[lv]
+}
+
+const (
+	LogFormatText = "text"
+	LogFormatJson = "json"
+)
+
+// Settings for the terminal, changed with SetLogLevel and SetLogFormat.
+// Instance log files always record everything as text.
+var (
+	logMinLevel           = LevelInfo
+	logFormat             = LogFormatText
+	logOut      io.Writer = os.Stderr
+)
+
+// Only log messages at level or above to the terminal.
+func SetLogLevel(level LogLevel) {
+	logMinLevel = level
+}
+
+// Log to the terminal as LogFormatText or LogFormatJson.
+func SetLogFormat(format string) error {
+	if format != LogFormatText && format != LogFormatJson {
+		return fmt.Errorf("invalid log format %q, expected text or json", format)
+	}
+	logFormat = format
+	return nil
+}
+
+// A Logger writes levelled messages to stderr, and if it belongs to an
+// instance, prefixes them with the instance name and also records them in
+// the instance log file.
+type Logger struct {
+	instance string
+	file     *rotatingLog
+}
+
+// StdLogger is for messages that don't concern a single instance.
+var StdLogger = &Logger{}
+
+// Secret values are replaced in every message before it is written.
+var (
+	redactionsMu sync.Mutex
+	redactions   []string
+)
+
+const redacted = "[REDACTED]"
+
+// Values shorter than this are not redacted, since replacing every
+// occurrence of a character or two would mangle the logs without hiding
+// much.
+const minRedactionLen = 4
+
+// Never log secret. A multi-line secret is also redacted line by line,
+// since command output is logged a line at a time. Return false if secret
+// is too short to be redacted.
+func addRedaction(secret string) bool {
+	redactionsMu.Lock()
+	defer redactionsMu.Unlock()
+	if len(strings.TrimSpace(secret)) < minRedactionLen {
+		return false
+	}
+	for _, s := range append([]string{secret}, strings.Split(secret, "\n")...) {
+		if s = strings.TrimSpace(s); len(s) >= minRedactionLen {
+			redactions = append(redactions, s)
+		}
+	}
+	// Replace longer secrets first, so a secret containing another is
+	// redacted whole.
+	sort.Slice(redactions, func(i, j int) bool { return len(redactions[i]) > len(redactions[j]) })
+	return true
+}
+
+// Return msg with every secret replaced.
+func Redact(msg string) string {
+	redactionsMu.Lock()
+	defer redactionsMu.Unlock()
+	for _, s := range redactions {
+		msg = strings.Replace(msg, s, redacted, -1)
+	}
+	return msg
+}
+
+type logEntry struct {
+	Time     time.Time
+	Level    string
+	Instance string `json:",omitempty"`
+	Caller   string
+	Message  string
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.Output(2, LevelDebug, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.Output(2, LevelInfo, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.Output(2, LevelWarn, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.Output(2, LevelError, fmt.Sprintf(format, v...))
+}
+
+// Return true if messages at level are shown on the terminal.
+func (l *Logger) enabled(level LogLevel) bool {
+	return level >= logMinLevel
+}
+
+// Return the file and line calldepth frames up from the function that calls
+// caller, as runtime.Caller would there.
+func caller(calldepth int) string {
+	if _, file, line, ok := runtime.Caller(calldepth + 1); ok {
+		return fmt.Sprintf("%s:%d", path.Base(file), line)
+	}
+	return "???:0"
+}
+
+// Write msg, attributing it to the caller calldepth frames up, as
+// log.Output does.
+func (l *Logger) Output(calldepth int, level LogLevel, msg string) {
+	l.write(caller(calldepth), level, msg)
+}
+
+// Write msg, attributing it to caller.
+func (l *Logger) write(caller string, level LogLevel, msg string) {
+	now := time.Now()
+	msg = Redact(strings.TrimRight(msg, "\n"))
+	if l.file != nil {
+		l.file.write(fmt.Sprintf("%s %s: %s: %s\n", now.Format(time.RFC3339), caller, level, msg))
+	}
+	if !l.enabled(level) {
+		return
+	}
+
+	if logFormat == LogFormatJson {
+		data, _ := json.Marshal(logEntry{
+			Time:     now,
+			Level:    level.String(),
+			Instance: l.instance,
+			Caller:   caller,
+			Message:  msg,
+		})
+		logOut.Write(append(data, '\n'))
+		return
+	}
+	prefix := now.Format("15:04:05") + " " + caller + ": "
+	if l.instance != "" {
+		prefix += "[" + l.instance + "] "
+	}
+	if level != LevelInfo {
+		prefix += level.String() + ": "
+	}
+	io.WriteString(logOut, prefix+msg+"\n")
+}
+
+// A lineWriter logs each line written to it, for streaming the output of a
+// command as it runs. The lines are attributed to where the lineWriter was
+// made, since they are written from whatever goroutine copies the output.
+type lineWriter struct {
+	l      *Logger
+	level  LogLevel
+	prefix string
+	caller string
+	buf    []byte
+}
+
+func (l *Logger) lineWriter(level LogLevel, prefix string) *lineWriter {
+	return &lineWriter{l: l, level: level, prefix: prefix, caller: caller(1)}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.l.write(w.caller, w.level, w.prefix+string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Log any final line that wasn't terminated.
+func (w *lineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.l.write(w.caller, w.level, w.prefix+string(w.buf))
+		w.buf = nil
+	}
+}
+
+// Return the logger for the instance, which records everything in
+// hobo/hobo.log once the instance directory exists.
+func (vm *Instance) Logger() *Logger {
+	if vm.logr == nil {
+		vm.logr = &Logger{
+			instance: vm.name,
+			file:     openRotatingLog(path.Join(vm.vmConfig.vmPath, "hobo/hobo.log")),
+		}
+	}
+	return vm.logr
+}
+
+// Instance logs are rotated once they reach logMaxBytes, keeping
+// logMaxBackups old files as hobo.log.1, hobo.log.2 and so on.
+const (
+	logMaxBytes   = 1 << 20
+	logMaxBackups = 3
+)
+
+// A rotatingLog is opened lazily since the instance directory may not exist
+// until the instance is cloned. Write errors are ignored, the log is only
+// ever a debugging aid.
+type rotatingLog struct {
+	mu    sync.Mutex
+	fname string
+	f     *os.File
+	size  int64
+}
+
+var (
+	rotatingLogsMu sync.Mutex
+	rotatingLogs   = make(map[string]*rotatingLog)
+)
+
+// Return the log for fname, shared by every logger in the process.
+func openRotatingLog(fname string) *rotatingLog {
+	rotatingLogsMu.Lock()
+	defer rotatingLogsMu.Unlock()
+	rl, ok := rotatingLogs[fname]
+	if !ok {
+		rl = &rotatingLog{fname: fname}
+		rotatingLogs[fname] = rl
+	}
+	return rl
+}
+
+func (rl *rotatingLog) write(line string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.f == nil && !rl.open() {
+		return
+	}
+	if rl.size+int64(len(line)) > logMaxBytes {
+		rl.rotate()
+		if rl.f == nil && !rl.open() {
+			return
+		}
+	}
+	n, _ := rl.f.WriteString(line)
+	rl.size += int64(n)
+}
+
+// Open the log file, recording the command line that opened it. Return
+// false if the instance directory doesn't exist yet.
+func (rl *rotatingLog) open() bool {
+	vmPath := path.Dir(path.Dir(rl.fname))
+	if _, err := os.Stat(vmPath); err != nil {
+		return false
+	}
+	if err := os.MkdirAll(path.Dir(rl.fname), 0755); err != nil {
+		return false
+	}
+	f, err := os.OpenFile(rl.fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return false
+	}
+	rl.f = f
+	rl.size = fi.Size()
+	header := fmt.Sprintf("%s --- %s (pid %d)\n", time.Now().Format(time.RFC3339),
+		strings.Join(os.Args, " "), os.Getpid())
+	n, _ := rl.f.WriteString(header)
+	rl.size += int64(n)
+	return true
+}
+
+func (rl *rotatingLog) rotate() {
+	rl.f.Close()
+	rl.f = nil
+	for i := logMaxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rl.fname, i), fmt.Sprintf("%s.%d", rl.fname, i+1))
+	}
+	os.Rename(rl.fname, rl.fname+".1")
+}
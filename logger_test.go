@@ -0,0 +1,59 @@
+package hobo
+
+import "testing"
+
+func TestRedact(t *testing.T) {
+	saved := redactions
+	defer func() { redactions = saved }()
+
+	tests := []struct {
+		name    string
+		secrets []string
+		msg     string
+		want    string
+	}{
+		{"none", nil, "token abcd1234", "token abcd1234"},
+		{"single", []string{"abcd1234"}, "token abcd1234 and abcd1234", "token [REDACTED] and [REDACTED]"},
+		{"too short", []string{"abc", " ab \n"}, "abc ab", "abc ab"},
+		{"trimmed", []string{"  abcd1234\n"}, "token abcd1234", "token [REDACTED]"},
+		{"longest first", []string{"abcd", "abcd1234"}, "abcd1234 abcd", "[REDACTED] [REDACTED]"},
+		{
+			"multi-line",
+			[]string{"-----BEGIN KEY-----\nc2VjcmV0\n-----END KEY-----"},
+			"line: c2VjcmV0",
+			"line: [REDACTED]",
+		},
+		{"short line", []string{"secret-value\nab"}, "ab secret-value", "ab [REDACTED]"},
+	}
+	for _, tt := range tests {
+		redactions = nil
+		for _, s := range tt.secrets {
+			addRedaction(s)
+		}
+		if got := Redact(tt.msg); got != tt.want {
+			t.Errorf("%s: Redact(%q) = %q, want %q", tt.name, tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestAddRedaction(t *testing.T) {
+	saved := redactions
+	defer func() { redactions = saved }()
+
+	tests := []struct {
+		secret string
+		want   bool
+	}{
+		{"", false},
+		{"abc", false},
+		{"  abc \n", false},
+		{"abcd", true},
+		{"ab\ncd", true},
+	}
+	for _, tt := range tests {
+		redactions = nil
+		if got := addRedaction(tt.secret); got != tt.want {
+			t.Errorf("addRedaction(%q) = %v, want %v", tt.secret, got, tt.want)
+		}
+	}
+}
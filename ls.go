@@ -0,0 +1,51 @@
+package hobo
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Return the status of every instance under the vms dir, plus any running
+// vms that hobo does not manage.
+func (ac *AppConfig) ListInstances(ctx context.Context) ([]*InstanceStatus, error) {
+	running, err := getRunningVmxSet(ctx, ac)
+	if err != nil {
+		return nil, err
+	}
+	fis, err := ioutil.ReadDir(ac.vmsDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	known := make(map[string]bool, len(fis))
+	statuses := make([]*InstanceStatus, 0, len(fis))
+	for _, fi := range fis {
+		if !fi.IsDir() || path.Ext(fi.Name()) != ".vmwarevm" {
+			continue
+		}
+		vm, err := readInstanceForStatus(*ac, strings.TrimSuffix(fi.Name(), ".vmwarevm"))
+		if err != nil {
+			return nil, err
+		}
+		st, err := vm.status(running, false)
+		if err != nil {
+			return nil, err
+		}
+		known[st.VmxFile] = true
+		statuses = append(statuses, st)
+	}
+	for fname := range running {
+		if known[fname] {
+			continue
+		}
+		ext := path.Ext(fname)
+		statuses = append(statuses, &InstanceStatus{
+			Name:    path.Base(fname[:len(fname)-len(ext)]),
+			State:   StateRunning,
+			VmxFile: fname,
+		})
+	}
+	return statuses, nil
+}
@@ -0,0 +1,176 @@
+package hobo
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// A MachineConfig describes one vm in a multi-machine .hobo file. The
+// boxcar and bootstrap default to those at the top level of the file.
+type MachineConfig struct {
+	Boxcar            *Boxcar
+	BootstrapCmdLines []string
+	BootstrapDir      string
+	BootstrapEnv      map[string]EnvSource
+	HostIdentity      *HostIdentity
+	Provisioners      []Provisioner
+	Forwards          []Forward
+	IdleSuspendAfter  Duration
+}
+
+// A Machine is a fully resolved vm definition. Key is the name used on the
+// command line and Name is the instance name under HoboDir/vms. A .hobo file
+// without Machines describes a single machine with an empty key.
+type Machine struct {
+	Key              string
+	Name             string
+	Boxcar           Boxcar
+	BootstrapDir     string
+	BootstrapEnv     map[string]EnvSource
+	HostIdentity     HostIdentity
+	Provisioners     []Provisioner
+	Forwards         []Forward
+	IdleSuspendAfter Duration
+
+	// baseDir is the directory of the .hobo file.
+	baseDir string
+}
+
+// Return the directory of the .hobo file, which local paths are relative to.
+func (lc *Config) baseDir() string {
+	if lc.configFile == "" {
+		return "."
+	}
+	return filepath.Dir(lc.configFile)
+}
+
+func (lc *Config) isMultiMachine() bool {
+	return len(lc.Machines) > 0
+}
+
+func (lc *Config) newMachine(key string, mc MachineConfig) *Machine {
+	m := &Machine{
+		Key:              key,
+		Name:             key,
+		Boxcar:           lc.Boxcar,
+		BootstrapDir:     lc.BootstrapDir,
+		BootstrapEnv:     lc.BootstrapEnv,
+		HostIdentity:     lc.HostIdentity,
+		Provisioners:     lc.Provisioners,
+		Forwards:         mc.Forwards,
+		IdleSuspendAfter: lc.IdleSuspendAfter,
+		baseDir:          lc.baseDir(),
+	}
+	if lc.Name != "" {
+		m.Name = lc.Name + "-" + key
+	}
+	if mc.Boxcar != nil {
+		m.Boxcar = *mc.Boxcar
+	}
+	if mc.IdleSuspendAfter != 0 {
+		m.IdleSuspendAfter = mc.IdleSuspendAfter
+	}
+	if mc.BootstrapCmdLines != nil {
+		m.Boxcar.BootstrapCmdLines = mc.BootstrapCmdLines
+	}
+	if mc.Provisioners != nil {
+		m.Provisioners = mc.Provisioners
+	}
+	if mc.BootstrapDir != "" {
+		m.BootstrapDir = mc.BootstrapDir
+	}
+	if mc.BootstrapEnv != nil {
+		m.BootstrapEnv = mc.BootstrapEnv
+	}
+	if mc.HostIdentity != nil {
+		m.HostIdentity = *mc.HostIdentity
+	}
+	return m
+}
+
+// Return all machines sorted by key.
+func (lc *Config) machines() []*Machine {
+	if !lc.isMultiMachine() {
+		return []*Machine{{Name: lc.Name, Boxcar: lc.Boxcar, BootstrapDir: lc.BootstrapDir,
+			BootstrapEnv: lc.BootstrapEnv, HostIdentity: lc.HostIdentity, Provisioners: lc.Provisioners, Forwards: lc.Forwards,
+			IdleSuspendAfter: lc.IdleSuspendAfter, baseDir: lc.baseDir()}}
+	}
+	keys := make([]string, 0, len(lc.Machines))
+	for key := range lc.Machines {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	machines := make([]*Machine, 0, len(keys))
+	for _, key := range keys {
+		machines = append(machines, lc.newMachine(key, lc.Machines[key]))
+	}
+	return machines
+}
+
+// Return the machine for key. An empty key selects the default machine.
+func (lc *Config) Machine(key string) (*Machine, error) {
+	if !lc.isMultiMachine() {
+		if key != "" {
+			return nil, fmt.Errorf("no machine %q, .hobo does not define Machines", key)
+		}
+		return lc.machines()[0], nil
+	}
+	if key == "" {
+		key = lc.DefaultMachine
+	}
+	if key == "" {
+		if len(lc.Machines) == 1 {
+			return lc.machines()[0], nil
+		}
+		return nil, fmt.Errorf("no machine specified and no DefaultMachine set")
+	}
+	mc, ok := lc.Machines[key]
+	if !ok {
+		return nil, fmt.Errorf("no machine %q", key)
+	}
+	return lc.newMachine(key, mc), nil
+}
+
+// Return the machines for keys, or all machines if there are none.
+func (lc *Config) MachinesFor(keys []string) ([]*Machine, error) {
+	if len(keys) == 0 {
+		return lc.machines(), nil
+	}
+	machines := make([]*Machine, 0, len(keys))
+	for _, key := range keys {
+		m, err := lc.Machine(key)
+		if err != nil {
+			return nil, err
+		}
+		machines = append(machines, m)
+	}
+	return machines, nil
+}
+
+func (lc *Config) validate() error {
+	if lc.isMultiMachine() && len(lc.Forwards) > 0 {
+		return fmt.Errorf("top-level Forwards are not used with Machines, set Forwards on each machine")
+	}
+	if lc.DefaultMachine != "" {
+		if _, ok := lc.Machines[lc.DefaultMachine]; !ok {
+			return fmt.Errorf("DefaultMachine %q is not defined in Machines", lc.DefaultMachine)
+		}
+	}
+	// Forwards from every machine share the host's ports.
+	fwds := make([]Forward, 0, 8)
+	for _, m := range lc.machines() {
+		fwds = append(fwds, m.Forwards...)
+		steps, err := m.bootstrapStepsWith(m.hostIdentityPlaceholder())
+		if err != nil {
+			return err
+		}
+		if err := validateSteps(steps); err != nil {
+			return err
+		}
+		if err := validateBootstrapEnv(m.BootstrapEnv); err != nil {
+			return err
+		}
+	}
+	return checkDuplicateForwards(fwds)
+}
@@ -0,0 +1,374 @@
+package hobo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// The operations below are the library interface to hobo. Each takes the key
+// of a machine in the config, or an empty key for the default machine, and
+// returns an *Error wrapping one of the Err values on failure.
+
+// Return the bootstrapped instance for a machine.
+func (c *Config) Instance(key string) (*Instance, error) {
+	m, err := c.Machine(key)
+	if err != nil {
+		return nil, opError("read", key, err)
+	}
+	vm, err := readInstanceForName(c.AppConfig, m.Name)
+	if os.IsNotExist(err) {
+		return nil, opError("read", m.Name, ErrNotFound)
+	}
+	return vm, opError("read", m.Name, err)
+}
+
+// Download and verify the boxcar archive for a machine. Return false if a
+// verified archive was already cached.
+func (c *Config) Fetch(ctx context.Context, key string) (fetched bool, err error) {
+	m, err := c.Machine(key)
+	if err != nil {
+		return false, opError("fetch", key, err)
+	}
+	fetched, err = fetch(ctx, c.AppConfig, m.Boxcar)
+	return fetched, opError("fetch", m.Boxcar.Name, err)
+}
+
+// Create and bootstrap a new instance for a machine from its fetched boxcar.
+// The instance is left running.
+func (c *Config) Clone(ctx context.Context, key string) (*Instance, error) {
+	m, err := c.Machine(key)
+	if err != nil {
+		return nil, opError("clone", key, err)
+	}
+	vm, err := clone(ctx, c, m)
+	if err != nil {
+		return nil, opError("clone", m.Name, err)
+	}
+	return vm, nil
+}
+
+// Start the instance for a machine, fetching and cloning it first if it does
+// not exist yet.
+func (c *Config) Start(ctx context.Context, key string) (*Instance, error) {
+	m, err := c.Machine(key)
+	if err != nil {
+		return nil, opError("start", key, err)
+	}
+	vm, err := startMachine(ctx, c, m)
+	if err != nil {
+		return nil, opError("start", m.Name, err)
+	}
+	return vm, nil
+}
+
+// Stop the instance for a machine and its port forwards. A hard stop powers
+// off the vm without waiting for the guest to shut down.
+func (c *Config) Stop(ctx context.Context, key string, hard bool) error {
+	vm, err := c.Instance(key)
+	if err != nil {
+		return err
+	}
+	return opError("stop", vm.name, stopInstance(ctx, vm, hard))
+}
+
+// Resume the suspended instance for a machine, wait for ssh and sync the
+// guest clock with the host.
+func (c *Config) Resume(ctx context.Context, key string) (*Instance, error) {
+	m, err := c.Machine(key)
+	if err != nil {
+		return nil, opError("resume", key, err)
+	}
+	vm, err := c.Instance(key)
+	if err != nil {
+		return nil, err
+	}
+	state, err := vm.syncState(ctx)
+	if err != nil {
+		return nil, opError("resume", vm.name, err)
+	}
+	if state != StateSuspended {
+		return nil, opError("resume", vm.name, fmt.Errorf("%w: vm is %s, not suspended", ErrInvalidState, state))
+	}
+	if vm, err = startMachine(ctx, c, m); err != nil {
+		return nil, opError("resume", m.Name, err)
+	}
+	return vm, nil
+}
+
+// Reboot the running instance for a machine and wait for ssh.
+func (c *Config) Restart(ctx context.Context, key string) error {
+	vm, err := c.Instance(key)
+	if err != nil {
+		return err
+	}
+	return opError("restart", vm.name, restartInstance(ctx, vm))
+}
+
+// Return the status of the instance for a machine. Unlike the other
+// operations, this succeeds for an instance that was never bootstrapped.
+func (c *Config) Status(ctx context.Context, key string) (*InstanceStatus, error) {
+	m, err := c.Machine(key)
+	if err != nil {
+		return nil, opError("status", key, err)
+	}
+	vm, err := readInstanceForStatus(c.AppConfig, m.Name)
+	if err != nil {
+		return nil, opError("status", m.Name, err)
+	}
+	running, err := getRunningVmxSet(ctx, &c.AppConfig)
+	if err != nil {
+		return nil, opError("status", m.Name, err)
+	}
+	st, err := vm.status(running, true)
+	if err != nil {
+		return nil, opError("status", m.Name, err)
+	}
+	return st, nil
+}
+
+// Run a command in the instance for a machine over ssh. See Instance.Exec.
+func (c *Config) Exec(ctx context.Context, key string, stdin io.Reader, stdout, stderr io.Writer, args ...string) error {
+	vm, err := c.Instance(key)
+	if err != nil {
+		return err
+	}
+	return vm.Exec(ctx, stdin, stdout, stderr, args...)
+}
+
+// Return the instance name, which is also its directory under HoboDir/vms.
+func (vm *Instance) Name() string {
+	return vm.name
+}
+
+// Run a command in the guest over ssh as the hobo user. Like ssh, the args
+// are joined with spaces and run by the guest's shell. A non-zero exit is
+// returned as an *ExitError.
+func (vm *Instance) Exec(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, args ...string) error {
+	ipAddr, err := vm.getIpAddr(ctx)
+	if err != nil {
+		return opError("exec", vm.name, err)
+	}
+	cmd := vm.sshCommand(ctx, ipAddr, vm.vmConfig.sshId, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		vm.checkSshFailure(err)
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			err = &ExitError{Args: args, ExitStatus: exitErr.ExitCode()}
+		}
+		return opError("exec", vm.name, err)
+	}
+	return nil
+}
+
+// Suspend the instance for a machine and stop its port forwards.
+func (c *Config) Suspend(ctx context.Context, key string) error {
+	vm, err := c.Instance(key)
+	if err != nil {
+		return err
+	}
+	return opError("suspend", vm.name, suspendInstance(ctx, vm))
+}
+
+// Destroy the instance for a machine and permanently remove all of its data.
+// This also removes an orphan left by a failed clone.
+func (c *Config) Remove(ctx context.Context, key string) error {
+	m, err := c.Machine(key)
+	if err != nil {
+		return opError("remove", key, err)
+	}
+	// An orphan from a failed clone has no config, so go by the vm
+	// directory.
+	vm, err := readInstanceForStatus(c.AppConfig, m.Name)
+	if err != nil {
+		return opError("remove", m.Name, err)
+	}
+	if _, err := os.Stat(vm.vmConfig.vmPath); os.IsNotExist(err) {
+		return opError("remove", m.Name, ErrNotFound)
+	}
+	if err := removeInstance(ctx, vm); err != nil {
+		return opError("remove", m.Name, err)
+	}
+	if err := c.AppConfig.updateSshConfigFile(); err != nil {
+		vm.Logger().Warnf("unable to update ssh config: %s", err)
+	}
+	return nil
+}
+
+// Rotate the ssh client key of the instance for a machine.
+func (c *Config) Rekey(ctx context.Context, key string) error {
+	vm, err := c.Instance(key)
+	if err != nil {
+		return err
+	}
+	ipAddr, err := vm.getIpAddr(ctx)
+	if err != nil {
+		return opError("rekey", vm.name, err)
+	}
+	if err := vm.rekey(ctx, ipAddr); err != nil {
+		return opError("rekey", vm.name, err)
+	}
+	vm.Logger().Infof("Rotated client key %s", vm.vmConfig.sshId)
+	return nil
+}
+
+// Run the steps for a machine in its running instance again. ProvisionAll
+// runs the Provisioners. The other modes run every bootstrap step, skipping
+// those that completed or are unchanged, and mark an instance whose
+// bootstrap never completed as bootstrapped once they have all run.
+func (c *Config) Provision(ctx context.Context, key string, mode ProvisionMode) error {
+	m, err := c.Machine(key)
+	if err != nil {
+		return opError("provision", key, err)
+	}
+	// Plain provision only reruns the Provisioners, BootstrapCmdLines are
+	// only ever run again if they didn't complete or have changed.
+	steps := m.provisionSteps()
+	if mode != ProvisionAll {
+		if steps, err = m.bootstrapSteps(ctx); err != nil {
+			return opError("provision", m.Name, err)
+		}
+	}
+	if len(steps) == 0 {
+		return opError("provision", m.Name, fmt.Errorf("no Provisioners"))
+	}
+
+	vm, err := c.Instance(key)
+	if err != nil {
+		return err
+	}
+	if running, err := vm.isRunning(ctx); err != nil {
+		return opError("provision", m.Name, err)
+	} else if !running {
+		return opError("provision", m.Name, ErrNotRunning)
+	}
+	ipAddr, err := vm.getIpAddr(ctx)
+	if err != nil {
+		return opError("provision", m.Name, err)
+	}
+	bootstrapped := !vm.vmConfig.TimeBootstrapped.IsZero()
+	hoboCmd := "provision"
+	if !bootstrapped {
+		hoboCmd = "bootstrap"
+	}
+	pr := newProvisionRun(vm, c, m, ipAddr, hoboCmd)
+	if err := pr.run(ctx, steps, mode); err != nil {
+		return opError("provision", m.Name, err)
+	}
+	if !bootstrapped && mode != ProvisionAll {
+		err := vm.updateConfig(func(c *vmConfig) error {
+			c.TimeBootstrapped = time.Now()
+			return nil
+		})
+		if err != nil {
+			return opError("provision", m.Name, fmt.Errorf("failed writing config: %v", err))
+		}
+		vm.Logger().Infof("Bootstrap complete")
+	}
+	return nil
+}
+
+// Warn and return true if the running instance for a machine still accepts
+// the shared insecure bootstrap key.
+func (c *Config) CheckInsecureKey(ctx context.Context, key string) bool {
+	vm, err := c.Instance(key)
+	if err != nil {
+		StdLogger.Warnf("unable to check insecure key: %v", err)
+		return false
+	}
+	return checkInsecureKey(ctx, &c.AppConfig, vm)
+}
+
+// Return the forwards for the instance of a machine, declared and adhoc,
+// and whether they are being forwarded now.
+func (c *Config) InstanceForwards(key string) (fwds []Forward, active bool, err error) {
+	vm, err := c.Instance(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if fwds, err = vm.readForwards(); err != nil {
+		return nil, false, opError("forward", vm.name, err)
+	}
+	return fwds, vm.forwardSupervisorPid() != 0, nil
+}
+
+// Add an adhoc forward to the running instance for a machine. The spec is
+// written [bind_addr:]host_port:guest_port.
+func (c *Config) AddForward(ctx context.Context, key, spec string) error {
+	vm, err := c.Instance(key)
+	if err != nil {
+		return err
+	}
+	fw, err := parseForward(spec)
+	if err != nil {
+		return opError("forward", vm.name, err)
+	}
+	fw.Adhoc = true
+	if running, err := vm.isRunning(ctx); err != nil {
+		return opError("forward", vm.name, err)
+	} else if !running {
+		return opError("forward", vm.name, ErrNotRunning)
+	}
+	err = vm.updateForwards(ctx, c.configFile, key, func(current []Forward) ([]Forward, error) {
+		return append(append([]Forward{}, current...), fw), nil
+	})
+	return opError("forward", vm.name, err)
+}
+
+// Remove the forward on a host address, written [bind_addr:]host_port, from
+// the instance for a machine.
+func (c *Config) RemoveForward(ctx context.Context, key, spec string) error {
+	vm, err := c.Instance(key)
+	if err != nil {
+		return err
+	}
+	hostAddr, err := parseForwardHostAddr(spec)
+	if err != nil {
+		return opError("forward", vm.name, err)
+	}
+	err = vm.updateForwards(ctx, c.configFile, key, func(current []Forward) ([]Forward, error) {
+		fwds := make([]Forward, 0, len(current))
+		for _, fw := range current {
+			if fw.hostAddr() != hostAddr {
+				fwds = append(fwds, fw)
+			}
+		}
+		if len(fwds) == len(current) {
+			return nil, fmt.Errorf("no forward on %s", hostAddr)
+		}
+		return fwds, nil
+	})
+	return opError("forward", vm.name, err)
+}
+
+// Keep the forwards for the instance of a machine up until ctx is done.
+// Start runs this in a background hobo process, so it is not usually
+// called directly.
+func (c *Config) SuperviseForwards(ctx context.Context, key string) error {
+	vm, err := c.Instance(key)
+	if err != nil {
+		return err
+	}
+	return opError("forward", vm.name, vm.superviseForwards(ctx))
+}
+
+// Return the power state of the instance, one of StateRunning,
+// StateSuspended or StateStopped.
+func (vm *Instance) State(ctx context.Context) (string, error) {
+	running, err := vm.isRunning(ctx)
+	if err != nil {
+		return "", opError("read", vm.name, err)
+	}
+	if running {
+		return StateRunning, nil
+	}
+	if vm.isSuspended() {
+		return StateSuspended, nil
+	}
+	return StateStopped, nil
+}
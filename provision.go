@@ -0,0 +1,680 @@
+package hobo
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// A Provisioner is one step run in the guest after bootstrap, and again by
+// hobo provision. Exactly one of Inline, Script, Upload or Template is set.
+// Local paths are relative to the .hobo file.
+type Provisioner struct {
+	Name string
+	// Inline is a list of shell command lines.
+	Inline []string
+	// Script is a local shell script that is uploaded and run.
+	Script string
+	// Upload is a local file or directory copied to Dest.
+	Upload string
+	// Template is a local text/template file rendered and copied to Dest.
+	Template string
+	Dest     string
+	// Env is added to the environment of Inline and Script steps.
+	Env map[string]string
+	// WorkDir is the guest directory Inline and Script steps run in, /tmp
+	// by default. A relative path is relative to the hobo user's home.
+	WorkDir string
+	// Sudo runs the step as root.
+	Sudo    bool
+	Timeout Duration
+
+	// guestScript is set for the scripts in the bootstrap directory. They
+	// run from the uploaded copy at this path, relative to WorkDir, rather
+	// than uploading Script again. Script still goes into the step hash.
+	guestScript string
+	// replace clears Dest before a directory is uploaded to it, so files
+	// removed locally don't linger in the guest.
+	replace bool
+}
+
+// The name of the step made from the boxcar BootstrapCmdLines.
+const bootstrapStepName = "bootstrap"
+
+// Return the Provisioners, each with its name filled in.
+func (m *Machine) provisionSteps() []Provisioner {
+	steps := make([]Provisioner, len(m.Provisioners))
+	for i, p := range m.Provisioners {
+		p.Name = p.name(i)
+		steps[i] = p
+	}
+	return steps
+}
+
+const (
+	// The bootstrap directory used when BootstrapDir is not set, relative
+	// to the .hobo file. It is fine for it not to exist.
+	defaultBootstrapDir = ".hobo.d/bootstrap"
+	// Where the bootstrap directory is uploaded, relative to the hobo
+	// user's home so it survives a reboot for provision -resume.
+	guestBootstrapDir = ".hobo/bootstrap"
+	// The name of the step that uploads the bootstrap directory.
+	bootstrapDirStepName = "bootstrap-dir"
+)
+
+// Scripts in the bootstrap directory run in lexical order, so they are
+// numbered like 10-packages.sh.
+var bootstrapScriptRe = regexp.MustCompile(`^\d+-.*\.sh$`)
+
+// Return the steps for the bootstrap directory: upload it in place of any
+// earlier copy, then run each of its scripts from the uploaded copy.
+func (m *Machine) bootstrapDirSteps() ([]Provisioner, error) {
+	dir := m.BootstrapDir
+	if dir == "" {
+		dir = defaultBootstrapDir
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(m.baseDir, dir)
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) && m.BootstrapDir == "" {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("bad BootstrapDir: %v", err)
+	}
+
+	steps := []Provisioner{{Name: bootstrapDirStepName, Upload: dir, Dest: guestBootstrapDir, replace: true}}
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && bootstrapScriptRe.MatchString(fi.Name()) {
+			steps = append(steps, Provisioner{
+				Name:        fi.Name(),
+				Script:      filepath.Join(dir, fi.Name()),
+				WorkDir:     guestBootstrapDir,
+				guestScript: "./" + fi.Name(),
+			})
+		}
+	}
+	return steps, nil
+}
+
+// Return every bootstrap step: the boxcar BootstrapCmdLines, the host
+// identity, the scripts in the bootstrap directory, then the Provisioners.
+// The host identity is read now, so this is only for running the steps.
+func (m *Machine) bootstrapSteps(ctx context.Context) ([]Provisioner, error) {
+	identity, err := m.hostIdentityStep(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.bootstrapStepsWith(identity)
+}
+
+// Return every bootstrap step, with identity, if not nil, as the host
+// identity step.
+func (m *Machine) bootstrapStepsWith(identity *Provisioner) ([]Provisioner, error) {
+	steps := make([]Provisioner, 0, len(m.Provisioners)+1)
+	if len(m.Boxcar.BootstrapCmdLines) > 0 {
+		steps = append(steps, Provisioner{
+			Name:   bootstrapStepName,
+			Inline: m.Boxcar.BootstrapCmdLines,
+		})
+	}
+	if identity != nil {
+		steps = append(steps, *identity)
+	}
+	dirSteps, err := m.bootstrapDirSteps()
+	if err != nil {
+		return nil, err
+	}
+	steps = append(steps, dirSteps...)
+	return append(steps, m.provisionSteps()...), nil
+}
+
+// Check the steps are valid and that each has its own name, since
+// completed steps are recorded by name.
+func validateSteps(steps []Provisioner) error {
+	names := make(map[string]bool, len(steps))
+	for i := range steps {
+		p := &steps[i]
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if names[p.Name] {
+			return fmt.Errorf("provisioner %s: duplicate name", p.Name)
+		}
+		names[p.Name] = true
+	}
+	return nil
+}
+
+// A stepState records a completed bootstrap step in the instance config.
+type stepState struct {
+	Name string
+	// Hash covers the step and any local files it uses.
+	Hash          string
+	TimeCompleted time.Time
+}
+
+func (vm *Instance) stepState(name string) *stepState {
+	for i := range vm.vmConfig.Steps {
+		if vm.vmConfig.Steps[i].Name == name {
+			return &vm.vmConfig.Steps[i]
+		}
+	}
+	return nil
+}
+
+// Record the state of a step and save it. A nil st marks the step as not
+// completed.
+func (vm *Instance) setStepState(name string, st *stepState) error {
+	return vm.updateConfig(func(c *vmConfig) error {
+		steps := make([]stepState, 0, len(c.Steps)+1)
+		for _, s := range c.Steps {
+			if s.Name != name {
+				steps = append(steps, s)
+			}
+		}
+		if st != nil {
+			steps = append(steps, *st)
+		}
+		c.Steps = steps
+		return nil
+	})
+}
+
+// Which steps a provisionRun runs.
+type ProvisionMode int
+
+const (
+	// Run every step.
+	ProvisionAll ProvisionMode = iota
+	// Skip the steps completed before the first one that didn't.
+	ProvisionResume
+	// Run only the steps that changed since they last completed.
+	ProvisionChanged
+)
+
+func (p *Provisioner) kind() string {
+	switch {
+	case p.Inline != nil:
+		return "inline"
+	case p.Script != "":
+		return "script"
+	case p.Upload != "":
+		return "upload"
+	case p.Template != "":
+		return "template"
+	}
+	return ""
+}
+
+// Return the name of the step, which defaults to its kind and position.
+func (p *Provisioner) name(i int) string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return fmt.Sprintf("%s-%d", p.kind(), i+1)
+}
+
+func (p *Provisioner) validate() error {
+	n := 0
+	for _, set := range []bool{p.Inline != nil, p.Script != "", p.Upload != "", p.Template != ""} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("provisioner %s: exactly one of Inline, Script, Upload or Template must be set", p.Name)
+	}
+	if (p.Upload != "" || p.Template != "") && p.Dest == "" {
+		return fmt.Errorf("provisioner %s: Dest is required", p.Name)
+	}
+	return nil
+}
+
+// An EnvSource says where on the host the value of a BootstrapEnv variable
+// comes from. Exactly one of FromEnv or FromFile is set. The value itself is
+// never stored in .hobo or the instance config.
+type EnvSource struct {
+	// FromEnv is the name of a host environment variable.
+	FromEnv string
+	// FromFile is a host file, relative to the .hobo file. Environment
+	// variables are expanded. A single trailing newline is removed, like
+	// $(cat file) in the shell.
+	FromFile string
+}
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func validateBootstrapEnv(env map[string]EnvSource) error {
+	for name, src := range env {
+		if !envNameRe.MatchString(name) {
+			return fmt.Errorf("BootstrapEnv %s: not a valid variable name", name)
+		}
+		if (src.FromEnv == "") == (src.FromFile == "") {
+			return fmt.Errorf("BootstrapEnv %s: exactly one of FromEnv or FromFile must be set", name)
+		}
+	}
+	return nil
+}
+
+// Read the BootstrapEnv values from the host. Each value is redacted from
+// all log output from here on, unless it is too short to redact.
+func (m *Machine) resolveBootstrapEnv() (map[string]string, error) {
+	values := make(map[string]string, len(m.BootstrapEnv))
+	for name, src := range m.BootstrapEnv {
+		var val string
+		if src.FromEnv != "" {
+			v, ok := os.LookupEnv(src.FromEnv)
+			if !ok {
+				return nil, fmt.Errorf("BootstrapEnv %s: host variable %s is not set", name, src.FromEnv)
+			}
+			val = v
+		} else {
+			fname := os.ExpandEnv(src.FromFile)
+			if !filepath.IsAbs(fname) {
+				fname = filepath.Join(m.baseDir, fname)
+			}
+			data, err := ioutil.ReadFile(fname)
+			if err != nil {
+				return nil, fmt.Errorf("BootstrapEnv %s: %v", name, err)
+			}
+			val = strings.TrimSuffix(string(data), "\n")
+		}
+		if !addRedaction(val) {
+			StdLogger.Warnf("BootstrapEnv %s is shorter than %d characters and will not be redacted", name, minRedactionLen)
+		}
+		values[name] = val
+	}
+	return values, nil
+}
+
+// Return a script prefix exporting the secret values. It is sent with the
+// script over the ssh session's stdin, so the values never appear in the
+// arguments of a process on either side, nor in a file in the guest.
+func secretExports(secrets map[string]string) []byte {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := &bytes.Buffer{}
+	for _, name := range names {
+		fmt.Fprintf(buf, "export %s=%s\n", name, shellQuote(secrets[name]))
+	}
+	return buf.Bytes()
+}
+
+// The data available to Template steps.
+type templateData struct {
+	Instance string
+	Machine  string
+	HostUser string
+	IpAddr   string
+	Env      map[string]string
+}
+
+// A provisionRun holds what every step of one run needs.
+type provisionRun struct {
+	vm     *Instance
+	ipAddr string
+	// baseDir is the directory of the .hobo file.
+	baseDir string
+	machine *Machine
+	// hoboCmd is exported to steps as HOBO_CMD.
+	hoboCmd string
+	// secrets are the resolved BootstrapEnv values.
+	secrets map[string]string
+}
+
+func newProvisionRun(vm *Instance, cfg *Config, m *Machine, ipAddr, hoboCmd string) *provisionRun {
+	return &provisionRun{vm: vm, ipAddr: ipAddr, baseDir: cfg.baseDir(), machine: m, hoboCmd: hoboCmd}
+}
+
+func (pr *provisionRun) localPath(fname string) string {
+	if filepath.IsAbs(fname) {
+		return fname
+	}
+	return filepath.Join(pr.baseDir, fname)
+}
+
+// Run the steps in order, stopping at the first failure. Each step is
+// recorded in the instance config as it completes.
+func (pr *provisionRun) run(ctx context.Context, steps []Provisioner, mode ProvisionMode) error {
+	secrets, err := pr.machine.resolveBootstrapEnv()
+	if err != nil {
+		return err
+	}
+	pr.secrets = secrets
+	hashes := make([]string, len(steps))
+	done := make([]*stepState, len(steps))
+	for i := range steps {
+		if hashes[i], err = pr.stepHash(&steps[i]); err != nil {
+			return fmt.Errorf("step %s: %w", steps[i].Name, err)
+		}
+		done[i] = pr.vm.stepState(steps[i].Name)
+	}
+	skip := skipSteps(mode, hashes, done)
+	for i := range steps {
+		p := &steps[i]
+		name, hash := p.Name, hashes[i]
+		if skip[i] && mode == ProvisionResume {
+			pr.vm.Logger().Infof("Skipping %s, completed %s", name, done[i].TimeCompleted.Format(time.RFC3339))
+			continue
+		} else if skip[i] {
+			pr.vm.Logger().Debugf("skipping %s, unchanged", name)
+			continue
+		}
+
+		if err := pr.vm.setStepState(name, nil); err != nil {
+			return err
+		}
+		pr.vm.Logger().Infof("Provisioning %s", name)
+		stepCtx, cancel := withTimeout(ctx, p.Timeout)
+		err = pr.runStep(stepCtx, p)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("step %s: %w", name, err)
+		}
+		st := &stepState{Name: name, Hash: hash, TimeCompleted: time.Now()}
+		if err := pr.vm.setStepState(name, st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return which steps to skip given the hash of each step and its state when
+// it last completed, nil if it never did.
+func skipSteps(mode ProvisionMode, hashes []string, done []*stepState) []bool {
+	skip := make([]bool, len(hashes))
+	skipping := mode == ProvisionResume
+	for i := range hashes {
+		if skipping && done[i] != nil {
+			skip[i] = true
+			continue
+		}
+		skipping = false
+		skip[i] = mode == ProvisionChanged && done[i] != nil && done[i].Hash == hashes[i]
+	}
+	return skip
+}
+
+// Hash the step definition along with any local files it uses, so editing
+// a script, template or upload changes the hash.
+func (pr *provisionRun) stepHash(p *Provisioner) (string, error) {
+	h := sha256.New()
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+	for _, fname := range []string{p.Script, p.Upload, p.Template} {
+		if fname == "" {
+			continue
+		}
+		root := pr.localPath(fname)
+		err := filepath.Walk(root, func(fname string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(root, fname)
+			if err != nil {
+				return err
+			}
+			io.WriteString(h, rel+"\x00")
+			f, err := os.Open(fname)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(h, f)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (pr *provisionRun) runStep(ctx context.Context, p *Provisioner) error {
+	switch p.kind() {
+	case "inline":
+		return pr.runScript(ctx, p, []byte(strings.Join(p.Inline, "\n")+"\n"))
+	case "script":
+		if p.guestScript != "" {
+			return pr.runScript(ctx, p, []byte("exec bash -euo pipefail "+shellQuote(p.guestScript)+"\n"))
+		}
+		script, err := ioutil.ReadFile(pr.localPath(p.Script))
+		if err != nil {
+			return err
+		}
+		return pr.runScript(ctx, p, script)
+	case "upload":
+		return pr.upload(ctx, p)
+	case "template":
+		return pr.uploadTemplate(ctx, p)
+	}
+	return fmt.Errorf("unknown provisioner kind")
+}
+
+// Return the environment shared by every step, followed by env.
+func (pr *provisionRun) env(env map[string]string) []string {
+	vars := []string{
+		"HOBO_HOST_USER=" + os.Getenv("LOGNAME"),
+		"HOBO_CMD=" + pr.hoboCmd,
+	}
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		vars = append(vars, k+"="+env[k])
+	}
+	return vars
+}
+
+func (pr *provisionRun) runScript(ctx context.Context, p *Provisioner, script []byte) error {
+	if len(pr.secrets) > 0 {
+		script = append(secretExports(pr.secrets), script...)
+	}
+	return pr.vm.runGuestScript(ctx, pr.ipAddr, p.Name, script, pr.env(p.Env), p.WorkDir, p.Sudo)
+}
+
+// Copy a local file to Dest, or the contents of a local directory into
+// Dest.
+func (pr *provisionRun) upload(ctx context.Context, p *Provisioner) error {
+	src := pr.localPath(p.Upload)
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		return pr.vm.writeGuestFile(ctx, pr.ipAddr, p.Dest, data, fi.Mode().Perm(), p.Sudo)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeTar(buf, src); err != nil {
+		return err
+	}
+	q := shellQuote(p.Dest)
+	remoteCmd := sudoCmd(p.Sudo, "mkdir -p "+q) + " && " + sudoCmd(p.Sudo, "tar -xf - -C "+q)
+	if p.replace {
+		remoteCmd = sudoCmd(p.Sudo, "rm -rf "+q) + " && " + remoteCmd
+	}
+	return pr.vm.runGuestCmd(ctx, pr.ipAddr, buf, remoteCmd)
+}
+
+func (pr *provisionRun) uploadTemplate(ctx context.Context, p *Provisioner) error {
+	src := pr.localPath(p.Template)
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New(path.Base(src)).Option("missingkey=error").ParseFiles(src)
+	if err != nil {
+		return err
+	}
+	data := templateData{
+		Instance: pr.vm.name,
+		Machine:  pr.machine.Key,
+		HostUser: os.Getenv("LOGNAME"),
+		IpAddr:   pr.ipAddr,
+		Env:      p.Env,
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		return err
+	}
+	return pr.vm.writeGuestFile(ctx, pr.ipAddr, p.Dest, buf.Bytes(), fi.Mode().Perm(), p.Sudo)
+}
+
+// Write a tar of the contents of dir.
+func writeTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(fname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fname)
+		if err != nil || rel == "." {
+			return err
+		}
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(fname); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(fname)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Quote s for the guest shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func sudoCmd(sudo bool, cmd string) string {
+	if sudo {
+		return "sudo " + cmd
+	}
+	return cmd
+}
+
+// Run remoteCmd in the guest with stdin, logging its output.
+func (vm *Instance) runGuestCmd(ctx context.Context, ipAddr string, stdin io.Reader, remoteCmd string) error {
+	cmd := vm.sshCommand(ctx, ipAddr, vm.vmConfig.sshId, remoteCmd)
+	cmd.Stdin = stdin
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		vm.Logger().Debugf("output:\n%s", out)
+	}
+	if err != nil {
+		vm.checkSshFailure(err)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("exit status %d: %s", exitErr.ExitCode(), lastLine(out))
+		}
+		return err
+	}
+	return nil
+}
+
+// Return the last non-empty line of out, which is usually the error.
+func lastLine(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return lines[len(lines)-1]
+}
+
+// Write data to fname in the guest, creating its directory.
+func (vm *Instance) writeGuestFile(ctx context.Context, ipAddr, fname string, data []byte, perm os.FileMode, sudo bool) error {
+	q := shellQuote(fname)
+	remoteCmd := sudoCmd(sudo, "mkdir -p "+shellQuote(path.Dir(fname))) +
+		" && " + sudoCmd(sudo, "tee "+q+" >/dev/null") +
+		" && " + sudoCmd(sudo, "chmod "+strconv.FormatUint(uint64(perm), 8)+" "+q)
+	return vm.runGuestCmd(ctx, ipAddr, bytes.NewReader(data), remoteCmd)
+}
+
+// The exit status of ssh itself failing, rather than the remote command.
+const sshExitStatus = 255
+
+// Run script in the guest in workDir with env under bash -euo pipefail. The
+// script is read by bash straight from the ssh session, so it never touches
+// the guest disk, and its commands get /dev/null on stdin so they can't
+// consume the rest of it. sudo closes descriptors above stderr, so the
+// session is moved to fd 3 by a shell running under sudo. The output is
+// logged line by line as it arrives, prefixed with name.
+func (vm *Instance) runGuestScript(ctx context.Context, ipAddr, name string, script []byte, env []string, workDir string, sudo bool) error {
+	envArgs := make([]string, len(env))
+	for i, kv := range env {
+		envArgs[i] = shellQuote(kv)
+	}
+	if workDir == "" {
+		workDir = "/tmp"
+	}
+	run := "env " + strings.Join(envArgs, " ") + " bash -c " + shellQuote("exec bash -euo pipefail /dev/fd/3 3<&0 </dev/null")
+	remoteCmd := "cd " + shellQuote(workDir) + " && " + sudoCmd(sudo, run)
+
+	cmd := vm.sshCommand(ctx, ipAddr, vm.vmConfig.sshId, remoteCmd)
+	cmd.Stdin = bytes.NewReader(script)
+	stdout := vm.Logger().lineWriter(LevelInfo, name+": ")
+	stderr := vm.Logger().lineWriter(LevelInfo, name+": ")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	stdout.Flush()
+	stderr.Flush()
+	vm.checkSshFailure(err)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if exitErr.ExitCode() == sshExitStatus {
+			return fmt.Errorf("ssh failed with exit status %d", sshExitStatus)
+		}
+		return fmt.Errorf("exit status %d", exitErr.ExitCode())
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+package hobo
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSkipSteps(t *testing.T) {
+	done := func(hash string) *stepState { return &stepState{Hash: hash} }
+	hashes := []string{"a", "b", "c"}
+	tests := []struct {
+		name string
+		mode ProvisionMode
+		done []*stepState
+		want []bool
+	}{
+		{"all fresh", ProvisionAll, []*stepState{nil, nil, nil}, []bool{false, false, false}},
+		{"all completed", ProvisionAll, []*stepState{done("a"), done("b"), done("c")}, []bool{false, false, false}},
+		{"resume fresh", ProvisionResume, []*stepState{nil, nil, nil}, []bool{false, false, false}},
+		{"resume after failure", ProvisionResume, []*stepState{done("a"), nil, nil}, []bool{true, false, false}},
+		// Once a step runs, everything after it runs too, even steps that
+		// completed in an earlier run.
+		{"resume gap", ProvisionResume, []*stepState{done("a"), nil, done("c")}, []bool{true, false, false}},
+		{"resume ignores hash", ProvisionResume, []*stepState{done("x"), done("y"), nil}, []bool{true, true, false}},
+		{"resume all completed", ProvisionResume, []*stepState{done("a"), done("b"), done("c")}, []bool{true, true, true}},
+		{"changed fresh", ProvisionChanged, []*stepState{nil, nil, nil}, []bool{false, false, false}},
+		{"changed none", ProvisionChanged, []*stepState{done("a"), done("b"), done("c")}, []bool{true, true, true}},
+		{"changed one", ProvisionChanged, []*stepState{done("a"), done("x"), done("c")}, []bool{true, false, true}},
+		{"changed incomplete", ProvisionChanged, []*stepState{done("a"), nil, done("c")}, []bool{true, false, true}},
+	}
+	for _, tt := range tests {
+		if got := skipSteps(tt.mode, hashes, tt.done); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: skipSteps() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStepHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		step    Provisioner
+		edit    func(dir string) error
+		changed bool
+	}{
+		{"unchanged script", Provisioner{Script: "setup.sh"}, nil, false},
+		{"edited script", Provisioner{Script: "setup.sh"}, func(dir string) error {
+			return ioutil.WriteFile(filepath.Join(dir, "setup.sh"), []byte("echo changed\n"), 0644)
+		}, true},
+		{"touched script", Provisioner{Script: "setup.sh"}, func(dir string) error {
+			return os.Chmod(filepath.Join(dir, "setup.sh"), 0755)
+		}, false},
+		{"unrelated file", Provisioner{Script: "setup.sh"}, func(dir string) error {
+			return ioutil.WriteFile(filepath.Join(dir, "other.sh"), []byte("echo other\n"), 0644)
+		}, false},
+		{"edited upload", Provisioner{Upload: "files", Dest: "/etc/app"}, func(dir string) error {
+			return ioutil.WriteFile(filepath.Join(dir, "files/a.conf"), []byte("a=2\n"), 0644)
+		}, true},
+		{"added upload", Provisioner{Upload: "files", Dest: "/etc/app"}, func(dir string) error {
+			return ioutil.WriteFile(filepath.Join(dir, "files/b.conf"), []byte("b=1\n"), 0644)
+		}, true},
+		{"renamed upload", Provisioner{Upload: "files", Dest: "/etc/app"}, func(dir string) error {
+			return os.Rename(filepath.Join(dir, "files/a.conf"), filepath.Join(dir, "files/c.conf"))
+		}, true},
+		{"edited template", Provisioner{Template: "app.tmpl", Dest: "/etc/app.conf"}, func(dir string) error {
+			return ioutil.WriteFile(filepath.Join(dir, "app.tmpl"), []byte("{{.Machine}}\n"), 0644)
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "hobo-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			files := map[string]string{
+				"setup.sh":     "echo setup\n",
+				"files/a.conf": "a=1\n",
+				"app.tmpl":     "{{.Instance}}\n",
+			}
+			for fname, data := range files {
+				fname = filepath.Join(dir, fname)
+				if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(fname, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			pr := &provisionRun{baseDir: dir}
+			before, err := pr.stepHash(&tt.step)
+			if err != nil {
+				t.Fatalf("stepHash() error = %v", err)
+			}
+			if tt.edit != nil {
+				if err := tt.edit(dir); err != nil {
+					t.Fatal(err)
+				}
+			}
+			after, err := pr.stepHash(&tt.step)
+			if err != nil {
+				t.Fatalf("stepHash() error = %v", err)
+			}
+			if changed := before != after; changed != tt.changed {
+				t.Errorf("hash changed = %v, want %v", changed, tt.changed)
+			}
+		})
+	}
+}
+
+func TestStepHashDefinition(t *testing.T) {
+	base := Provisioner{Name: "setup", Inline: []string{"make install"}}
+	tests := []struct {
+		name    string
+		step    Provisioner
+		changed bool
+	}{
+		{"same", Provisioner{Name: "setup", Inline: []string{"make install"}}, false},
+		{"command", Provisioner{Name: "setup", Inline: []string{"make check"}}, true},
+		{"env", Provisioner{Name: "setup", Inline: []string{"make install"}, Env: map[string]string{"A": "1"}}, true},
+		{"sudo", Provisioner{Name: "setup", Inline: []string{"make install"}, Sudo: true}, true},
+		{"workdir", Provisioner{Name: "setup", Inline: []string{"make install"}, WorkDir: "src"}, true},
+	}
+	pr := &provisionRun{baseDir: "."}
+	want, err := pr.stepHash(&base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		got, err := pr.stepHash(&tt.step)
+		if err != nil {
+			t.Fatalf("%s: stepHash() error = %v", tt.name, err)
+		}
+		if changed := got != want; changed != tt.changed {
+			t.Errorf("%s: hash changed = %v, want %v", tt.name, changed, tt.changed)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"", `''`},
+		{"plain", `'plain'`},
+		{"two words", `'two words'`},
+		{"it's", `'it'\''s'`},
+		{"''", `''\'''\'''`},
+		{`$HOME "x" \n`, `'$HOME "x" \n'`},
+		{"a\nb", "'a\nb'"},
+	}
+	for _, tt := range tests {
+		got := shellQuote(tt.s)
+		if got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.s, got, tt.want)
+			continue
+		}
+		// The shell must read back exactly the original string.
+		out, err := exec.Command("sh", "-c", "printf %s "+got).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != tt.s {
+			t.Errorf("sh read back shellQuote(%q) as %q", tt.s, out)
+		}
+	}
+}
+
+func TestSecretExports(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets map[string]string
+		want    string
+	}{
+		{"none", nil, ""},
+		{"sorted", map[string]string{"B": "2", "A": "1"}, "export A='1'\nexport B='2'\n"},
+		{"quoted", map[string]string{"TOKEN": "it's $secret"}, "export TOKEN='it'\\''s $secret'\n"},
+		{"multi-line", map[string]string{"KEY": "line1\nline2"}, "export KEY='line1\nline2'\n"},
+	}
+	for _, tt := range tests {
+		if got := string(secretExports(tt.secrets)); got != tt.want {
+			t.Errorf("%s: secretExports() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
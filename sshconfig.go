@@ -0,0 +1,224 @@
+package hobo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	sshConfigBlockBegin = "# BEGIN hobo managed block - do not edit"
+	sshConfigBlockEnd   = "# END hobo managed block"
+)
+
+// Return the ssh options needed to reach the instance without any other
+// arguments to ssh.
+func (vm *Instance) sshClientConfigMap(ipAddr string) map[string]string {
+	cm := vm.sshConfigMap()
+	cm["Hostname"] = ipAddr
+	cm["User"] = "hobo"
+	cm["IdentityFile"] = vm.vmConfig.sshId
+	return cm
+}
+
+// Return an ssh config clause for the instance at the given address.
+func (vm *Instance) sshConfigClause(ipAddr string) string {
+	vars := map[string]string{
+		"ip_addr": ipAddr,
+		"name":    vm.name,
+	}
+	getter := func(k string) string { return vars[k] }
+	header := os.Expand("Host ${name} hobo-${name} ${ip_addr}", getter)
+	lines := make([]string, 0, 16)
+
+	for k, v := range vm.sshClientConfigMap(ipAddr) {
+		lines = append(lines, "  "+k+" "+v)
+	}
+	sort.Strings(lines)
+	return header + "\n" + strings.Join(lines, "\n") + "\n"
+}
+
+// The ssh config for an instance. Clause is the same as Options written out
+// as a Host clause for Hosts.
+type SshConfig struct {
+	Name    string
+	Hosts   []string
+	Options map[string]string
+	Clause  string
+}
+
+// Return the ssh config needed to reach the instance at its current
+// address.
+func (vm *Instance) SshConfig(ctx context.Context) (*SshConfig, error) {
+	ipAddr, err := vm.getIpAddr(ctx)
+	if err != nil {
+		return nil, opError("ssh-config", vm.name, err)
+	}
+	return &SshConfig{
+		Name:    vm.name,
+		Hosts:   []string{vm.name, "hobo-" + vm.name, ipAddr},
+		Options: vm.sshClientConfigMap(ipAddr),
+		Clause:  vm.sshConfigClause(ipAddr),
+	}, nil
+}
+
+// Return the arguments to ssh that log in to the instance at its current
+// address as the hobo user.
+func (vm *Instance) SshArgs(ctx context.Context) ([]string, error) {
+	ipAddr, err := vm.getIpAddr(ctx)
+	if err != nil {
+		return nil, opError("ssh", vm.name, err)
+	}
+	args := vm.sshCmdArgs()
+	return append(args[1:], "-i", vm.vmConfig.sshId, "hobo@"+ipAddr), nil
+}
+
+// The file holding clauses for every instance. It is pulled into the user's
+// ssh config by an Include directive in the managed block.
+func (ac *AppConfig) SshConfigFile() string {
+	return path.Join(ac.HoboDir, "ssh_config")
+}
+
+// Return the user's own ssh config, where ssh-config -install adds the
+// managed block.
+func UserSshConfigFile() string {
+	return os.ExpandEnv("$HOME/.ssh/config")
+}
+
+// Return true if ssh-config -install has been run for this arena.
+func (ac *AppConfig) sshConfigInstalled() bool {
+	_, err := os.Stat(ac.SshConfigFile())
+	return err == nil
+}
+
+// Regenerate the managed ssh config file from all bootstrapped instances.
+// Instances without a known address are skipped.
+func (ac *AppConfig) writeSshConfigFile() error {
+	fnames, err := ioutil.ReadDir(ac.vmsDir())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	buf := bytes.NewBufferString("# Generated by hobo - changes will be overwritten.\n")
+	for _, fi := range fnames {
+		if path.Ext(fi.Name()) != ".vmwarevm" {
+			continue
+		}
+		name := strings.TrimSuffix(fi.Name(), ".vmwarevm")
+		vm, err := readInstanceForName(*ac, name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if vm.vmConfig.IpAddr == "" {
+			continue
+		}
+		buf.WriteString("\n")
+		buf.WriteString(vm.sshConfigClause(vm.vmConfig.IpAddr))
+	}
+	if err := os.MkdirAll(ac.HoboDir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(ac.SshConfigFile(), buf.Bytes(), 0644)
+}
+
+// Refresh the managed ssh config file if it has been installed.
+func (ac *AppConfig) updateSshConfigFile() error {
+	if !ac.sshConfigInstalled() {
+		return nil
+	}
+	return ac.writeSshConfigFile()
+}
+
+// Make sure the user's ssh config includes the managed file. The block is
+// placed at the top since Include is scoped to the Host clause it follows.
+// Anything outside the block is left untouched. A symlinked config, say
+// from a dotfiles repo, is updated in place rather than replaced.
+func (ac *AppConfig) InstallSshConfig() error {
+	if err := ac.writeSshConfigFile(); err != nil {
+		return err
+	}
+	fname := UserSshConfigFile()
+	if target, err := filepath.EvalSymlinks(fname); err == nil {
+		fname = target
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	mode := os.FileMode(0600)
+	if fi, err := os.Stat(fname); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	content, err := rewriteSshConfigBlock(string(data), ac.SshConfigFile())
+	if err != nil {
+		return fmt.Errorf("%v in %s", err, fname)
+	}
+	if content == string(data) {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(fname), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(fname, []byte(content), mode)
+}
+
+// Return the user's ssh config with a managed block including includeFile,
+// replacing the block if there is one already and otherwise adding it at the
+// top.
+func rewriteSshConfigBlock(content, includeFile string) (string, error) {
+	block := strings.Join([]string{
+		sshConfigBlockBegin,
+		"Include " + includeFile,
+		sshConfigBlockEnd,
+	}, "\n") + "\n"
+
+	begin := strings.Index(content, sshConfigBlockBegin)
+	end := strings.Index(content, sshConfigBlockEnd)
+	if begin >= 0 && end > begin {
+		rest := content[end+len(sshConfigBlockEnd):]
+		rest = strings.TrimPrefix(rest, "\n")
+		return content[:begin] + block + rest, nil
+	} else if begin >= 0 || end >= 0 {
+		return "", fmt.Errorf("damaged hobo managed block")
+	}
+	if content != "" {
+		block += "\n"
+	}
+	return block + content, nil
+}
+
+// Write a file by renaming a temp file into place so readers never see a
+// partial write.
+func writeFileAtomic(fname string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(path.Dir(fname), "."+path.Base(fname)+"-")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	defer os.Remove(tmpName)
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, fname)
+}
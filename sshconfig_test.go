@@ -0,0 +1,35 @@
+package hobo
+
+import "testing"
+
+func TestRewriteSshConfigBlock(t *testing.T) {
+	const include = "/home/u/.hobo.d/ssh_config"
+	block := sshConfigBlockBegin + "\nInclude " + include + "\n" + sshConfigBlockEnd + "\n"
+	oldBlock := sshConfigBlockBegin + "\nInclude /old/ssh_config\n" + sshConfigBlockEnd + "\n"
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{"empty", "", block, false},
+		{"prepended", "Host *\n  User u\n", block + "\nHost *\n  User u\n", false},
+		{"unchanged", block + "\nHost *\n", block + "\nHost *\n", false},
+		{"replaced", oldBlock + "\nHost *\n", block + "\nHost *\n", false},
+		{"replaced in place", "# mine\n" + oldBlock + "Host *\n", "# mine\n" + block + "Host *\n", false},
+		{"no trailing newline", "# mine\n" + sshConfigBlockBegin + "\n" + sshConfigBlockEnd, "# mine\n" + block, false},
+		{"missing end", sshConfigBlockBegin + "\nHost *\n", "", true},
+		{"missing begin", "Host *\n" + sshConfigBlockEnd + "\n", "", true},
+		{"reversed", sshConfigBlockEnd + "\n" + sshConfigBlockBegin + "\n", "", true},
+	}
+	for _, tt := range tests {
+		got, err := rewriteSshConfigBlock(tt.content, include)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: rewriteSshConfigBlock() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: rewriteSshConfigBlock() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package hobo
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Power states as reported by status and ls.
+const (
+	StateRunning      = "running"
+	StateSuspended    = "suspended"
+	StateStopped      = "stopped"
+	StateNotCreated   = "not-created"
+	StatePartialClone = "partial-clone"
+)
+
+type DiskUsage struct {
+	Name  string
+	Bytes int64
+}
+
+// The status of an instance. This is also the json output of ls and status,
+// so fields should only ever be added.
+type InstanceStatus struct {
+	Name             string
+	State            string
+	VmxFile          string
+	IpAddr           string
+	LiveIpAddr       string
+	Boxcar           string
+	BoxcarVersion    string
+	TimeBootstrapped time.Time
+	TimeStarted      time.Time
+	TimeLastUsed     time.Time
+	Uptime           time.Duration `json:"-"`
+	UptimeSeconds    int64
+	Disks            []DiskUsage
+	ProjectFile      string
+	// Orphan is set for a vm with a vmx but no hobo config, usually a clone
+	// that died part way through.
+	Orphan bool
+	// BootstrapIncomplete is set for a vm whose bootstrap steps did not all
+	// complete.
+	BootstrapIncomplete bool
+	// InsecureKeyAccepted is only checked by status for running vms.
+	InsecureKeyAccepted bool
+	// Transition is the operation recorded as under way, if any. One left
+	// by an interrupted command stays until the next operation on the vm.
+	Transition       string
+	TimeStateChanged time.Time
+}
+
+// Return the space allocated for all of the instance disks.
+func (st *InstanceStatus) DiskBytes() int64 {
+	total := int64(0)
+	for _, du := range st.Disks {
+		total += du.Bytes
+	}
+	return total
+}
+
+// Split and snapshot extents belong to the disk named by their descriptor.
+var vmdkExtentRe = regexp.MustCompile(`-(s\d{3}|\d{6})\.vmdk$`)
+
+// Return the space actually allocated for each virtual disk in the
+// instance, which is usually much less than the apparent file size.
+func (vm *Instance) diskUsage() ([]DiskUsage, error) {
+	fnames, err := filepath.Glob(path.Join(vm.vmConfig.vmPath, "*.vmdk"))
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[string]int64)
+	for _, fname := range fnames {
+		fi, err := os.Stat(fname)
+		if err != nil {
+			return nil, err
+		}
+		name := vmdkExtentRe.ReplaceAllString(path.Base(fname), ".vmdk")
+		size := fi.Size()
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			size = st.Blocks * 512
+		}
+		usage[name] += size
+	}
+	disks := make([]DiskUsage, 0, len(usage))
+	for name, size := range usage {
+		disks = append(disks, DiskUsage{Name: name, Bytes: size})
+	}
+	sort.Slice(disks, func(i, j int) bool { return disks[i].Name < disks[j].Name })
+	return disks, nil
+}
+
+// Return the last time the instance was used. vmware writes to its log
+// for as long as the vm runs, so that is a decent proxy.
+func (vm *Instance) lastUsed() time.Time {
+	for _, fname := range []string{path.Join(vm.vmConfig.vmPath, "vmware.log"), vm.vmConfig.vmxFile} {
+		if fi, err := os.Stat(fname); err == nil {
+			return fi.ModTime()
+		}
+	}
+	return time.Time{}
+}
+
+func (vm *Instance) isSuspended() bool {
+	fnames, _ := filepath.Glob(path.Join(vm.vmConfig.vmPath, "*.vmss"))
+	return len(fnames) > 0
+}
+
+// Read whatever config exists for the instance. A partial clone has no
+// config yet, which is not an error here.
+func readInstanceForStatus(ac AppConfig, name string) (*Instance, error) {
+	vm, err := newInstanceForName(ac, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.readConfig(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// Return the power state of the instance given the set of running vmx files.
+func (vm *Instance) powerState(running map[string]bool) string {
+	if _, err := os.Stat(vm.vmConfig.vmxFile); err != nil {
+		return StateNotCreated
+	}
+	if _, err := os.Stat(vm.vmConfig.configFile); err != nil {
+		return StatePartialClone
+	}
+	if running[vm.vmConfig.vmxFile] {
+		return StateRunning
+	}
+	if vm.isSuspended() {
+		return StateSuspended
+	}
+	return StateStopped
+}
+
+// Gather the status of an instance. Checking the live ip address reads the
+// dhcp lease file once rather than waiting on it.
+func (vm *Instance) status(running map[string]bool, live bool) (*InstanceStatus, error) {
+	st := &InstanceStatus{
+		Name:             vm.name,
+		State:            vm.powerState(running),
+		VmxFile:          vm.vmConfig.vmxFile,
+		IpAddr:           vm.vmConfig.IpAddr,
+		Boxcar:           vm.vmConfig.Boxcar.Name,
+		BoxcarVersion:    vm.vmConfig.Boxcar.Version,
+		TimeBootstrapped: vm.vmConfig.TimeBootstrapped,
+		TimeStarted:      vm.vmConfig.TimeStarted,
+		ProjectFile:      vm.vmConfig.ProjectFile,
+		TimeStateChanged: vm.vmConfig.TimeStateChanged,
+	}
+	if isTransitional(vm.vmConfig.State) {
+		st.Transition = vm.vmConfig.State
+	}
+	st.TimeLastUsed = vm.lastUsed()
+	st.Orphan = st.State == StatePartialClone
+	st.BootstrapIncomplete = !st.Orphan && st.State != StateNotCreated && st.TimeBootstrapped.IsZero()
+	if st.State == StateRunning && !st.TimeStarted.IsZero() {
+		st.Uptime = time.Since(st.TimeStarted).Truncate(time.Second)
+		st.UptimeSeconds = int64(st.Uptime / time.Second)
+	}
+	if live && st.State == StateRunning {
+		if macAddr, err := vm.getMacAddr(); err == nil {
+			st.LiveIpAddr, _ = vm.findIpAddrFromVmdhcp(macAddr)
+		}
+	}
+	disks, err := vm.diskUsage()
+	if err != nil {
+		return nil, err
+	}
+	st.Disks = disks
+	return st, nil
+}
+
+func getRunningVmxSet(ctx context.Context, ac *AppConfig) (map[string]bool, error) {
+	fnames, err := getRunningVmxPaths(ctx, ac)
+	if err != nil {
+		return nil, err
+	}
+	running := make(map[string]bool, len(fnames))
+	for _, fname := range fnames {
+		running[fname] = true
+	}
+	return running, nil
+}
+
+// Warn and return true if the guest still accepts the shared insecure
+// bootstrap key.
+func checkInsecureKey(ctx context.Context, ac *AppConfig, vm *Instance) bool {
+	insecureSshId, err := ac.writeBootstrapInsecureKey()
+	if err != nil {
+		vm.Logger().Warnf("unable to check insecure key: %v", err)
+		return false
+	}
+	ipAddr, err := vm.getIpAddr(ctx)
+	if err != nil {
+		vm.Logger().Warnf("unable to check insecure key: %v", err)
+		return false
+	}
+	accepted, err := vm.acceptsKey(ctx, ipAddr, insecureSshId)
+	if err != nil {
+		vm.Logger().Warnf("unable to check insecure key: %v", err)
+	} else if accepted {
+		vm.Logger().Warnf("still accepts the insecure bootstrap key, run `hobo rekey` to revoke it")
+	}
+	return accepted
+}
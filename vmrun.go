@@ -0,0 +1,161 @@
+package hobo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Errors classified from vmrun output.
+var (
+	ErrFileLocked      = errors.New("vm file is locked by another process")
+	ErrToolsNotRunning = errors.New("VMware Tools are not running in the guest")
+	ErrLicenseExpired  = errors.New("VMware license has expired")
+
+	// vmrun occasionally fails to reach the vmware host process, especially
+	// just after the vm changes state. These failures are worth a retry.
+	errVmrunTransient = errors.New("transient vmrun failure")
+)
+
+// vmrun error messages, lower cased and checked in order. Output that
+// matches none of them, including vmrun's own "Unknown error", is left
+// unclassified and is never retried.
+var vmrunErrorPatterns = []struct {
+	substr string
+	err    error
+}{
+	{"the vmware tools are not running in the virtual machine", ErrToolsNotRunning},
+	{"the virtual machine is not powered on", ErrNotRunning},
+	{"the virtual machine is not running", ErrNotRunning},
+	{"this virtual machine appears to be in use", ErrFileLocked},
+	{"the file is already in use", ErrFileLocked},
+	{"failed to lock the file", ErrFileLocked},
+	{"license has expired", ErrLicenseExpired},
+	{"evaluation period has expired", ErrLicenseExpired},
+	{"unable to connect to host", errVmrunTransient},
+	{"cannot connect to the virtual machine", errVmrunTransient},
+}
+
+// A VmrunError is a failed vmrun command. Err is one of the Err values when
+// the output was recognized, otherwise the underlying exec error.
+type VmrunError struct {
+	Args       []string
+	ExitStatus int
+	Output     string
+	Err        error
+}
+
+func (e *VmrunError) Error() string {
+	msg := e.Output
+	if msg == "" {
+		msg = e.Err.Error()
+	}
+	return fmt.Sprintf("%s %s: %s", path.Base(e.Args[0]), strings.Join(e.Args[1:], " "), msg)
+}
+
+func (e *VmrunError) Unwrap() error {
+	return e.Err
+}
+
+func classifyVmrunOutput(out string) error {
+	lower := strings.ToLower(out)
+	for _, p := range vmrunErrorPatterns {
+		if strings.Contains(lower, p.substr) {
+			return p.err
+		}
+	}
+	return nil
+}
+
+// Run vmrun and return its output. vmrun reports errors on stdout, so any
+// failure is classified from the combined output.
+func vmrunOutput(ctx context.Context, l *Logger, bin string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, bin, args...)
+	l.Debugf("run %v", cmd.Args)
+	// vmware missed the memo on how to use stdout/stderr properly.
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := cmd.Run()
+	if err == nil {
+		return out.Bytes(), nil
+	}
+
+	rc := 0
+	if _, ok := err.(*exec.ExitError); ok {
+		rc = cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
+	}
+	// The output is part of the returned error, so only log it verbosely.
+	l.Debugf("cmd failed: %v rc: %v\nstderr: %s", cmd.Args, rc, out)
+	vErr := &VmrunError{
+		Args:       cmd.Args,
+		ExitStatus: rc,
+		Output:     strings.TrimPrefix(strings.TrimSpace(out.String()), "Error: "),
+		Err:        err,
+	}
+	if ctx.Err() != nil {
+		vErr.Err = ctx.Err()
+	} else if cErr := classifyVmrunOutput(out.String()); cErr != nil {
+		vErr.Err = cErr
+	}
+	return out.Bytes(), vErr
+}
+
+func runVmrun(ctx context.Context, l *Logger, bin string, args ...string) error {
+	_, err := vmrunOutput(ctx, l, bin, args...)
+	return err
+}
+
+const vmrunRetries = 4
+
+// Call fn until it succeeds, fails with an error that is not transient, or
+// runs out of retries. A locked file is considered transient since vmware
+// holds the lock briefly while the vm changes state.
+func retryVmrun(ctx context.Context, l *Logger, fn func() error) error {
+	delay := 500 * time.Millisecond
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i == vmrunRetries-1 {
+			return err
+		}
+		if !errors.Is(err, errVmrunTransient) && !errors.Is(err, ErrFileLocked) {
+			return err
+		}
+		l.Warnf("retrying in %s: %v", delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// Return a description of the process holding the lock on a vmx, or an
+// empty string if it can't be found. vmware keeps its lock files in a
+// .lck directory next to the locked file.
+func vmxLockHolder(ctx context.Context, vmxFile string) string {
+	out, err := exec.CommandContext(ctx, "ps", "-axo", "pid=,command=").Output()
+	if err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.Contains(line, vmxFile) {
+				fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+				if len(fields) == 2 {
+					return fmt.Sprintf("pid %s (%s)", fields[0], strings.TrimSpace(fields[1]))
+				}
+			}
+		}
+	}
+	lockDir := vmxFile + ".lck"
+	if fis, err := ioutil.ReadDir(lockDir); err == nil && len(fis) > 0 {
+		return path.Join(lockDir, fis[0].Name())
+	}
+	return ""
+}
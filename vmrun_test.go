@@ -0,0 +1,25 @@
+package hobo
+
+import "testing"
+
+func TestClassifyVmrunOutput(t *testing.T) {
+	tests := []struct {
+		out  string
+		want error
+	}{
+		{"", nil},
+		{"Error: Unknown error", nil},
+		{"Error: The virtual machine is not powered on: /vms/a.vmx", ErrNotRunning},
+		{"Error: The VMware Tools are not running in the virtual machine: /vms/a.vmx", ErrToolsNotRunning},
+		{"Error: This virtual machine appears to be in use.", ErrFileLocked},
+		{"Error: Failed to lock the file", ErrFileLocked},
+		{"Error: Your evaluation period has expired", ErrLicenseExpired},
+		{"Error: Unable to connect to host.", errVmrunTransient},
+		{"Error: Cannot connect to the virtual machine", errVmrunTransient},
+	}
+	for _, tt := range tests {
+		if got := classifyVmrunOutput(tt.out); got != tt.want {
+			t.Errorf("classifyVmrunOutput(%q) = %v, want %v", tt.out, got, tt.want)
+		}
+	}
+}